@@ -0,0 +1,63 @@
+package exphttp
+
+import (
+	"encoding/json"
+	"expvar"
+	"time"
+)
+
+// BuildInfo is the version information published by PublishBuildInfo.
+type BuildInfo struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit"`
+	BuildTime time.Time `json:"build_time"`
+}
+
+// PublishBuildInfo publishes a static "buildinfo" var describing the running
+// build, so that metric changes can be correlated with deploys. ExpPoller
+// passes it through as strings, and WriteTo and PrometheusHandler expose it
+// as an exphttp_build_info gauge with value 1 and the details as labels. It
+// should only be called once.
+func PublishBuildInfo(version, commit string, buildTime time.Time) {
+	b, _ := json.Marshal(BuildInfo{version, commit, buildTime})
+	expvar.Publish("buildinfo", expvar.Func(func() interface{} {
+		return json.RawMessage(b)
+	}))
+}
+
+// buildInfo decodes the "buildinfo" var, returning false if it isn't present.
+func (x *ExpPoller) buildInfo() (BuildInfo, bool, error) {
+	var b BuildInfo
+	raw, f := x.Vars["buildinfo"]
+	if !f {
+		return b, false, nil
+	}
+	err := json.Unmarshal(raw, &b)
+	return b, err == nil, err
+}
+
+// BuildInfo records the "version", "commit" and "build_time" string values
+// from a var published by PublishBuildInfo, if present.
+func (x *ExpPoller) BuildInfo() error {
+	b, ok, err := x.buildInfo()
+	if !ok {
+		return err
+	}
+	x.PluginName = "build"
+	x.record("version", b.Version)
+	x.record("commit", b.Commit)
+	x.record("build_time", b.BuildTime.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// writeBuildInfo writes the build info to p as an info-style gauge.
+func (x *ExpPoller) writeBuildInfo(p *promWriter) error {
+	b, ok, err := x.buildInfo()
+	if !ok {
+		return err
+	}
+	labels := promLabel("version", b.Version) + "," + promLabel("commit", b.Commit) + "," +
+		promLabel("build_time", b.BuildTime.UTC().Format(time.RFC3339))
+	p.sample("exphttp_build_info", "gauge", labels, 1)
+	return nil
+}
@@ -0,0 +1,73 @@
+package exphttp
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// EWMA is a thread-safe, lock-free exponentially weighted moving average.
+//
+// Unlike the windowed MovingAverage, which weights every value in its interval
+// equally and then drops it all at once, an EWMA weights recent values most
+// and lets older ones fade out gradually. It needs no background goroutine and
+// tracks spikes smoothly, but has no hard window: every value ever added has
+// some (vanishing) influence.
+type EWMA struct {
+	bits     uint64
+	last     int64
+	alpha    float64
+	halfLife time.Duration
+}
+
+// NewEWMA makes a new EWMA in which each Add moves the average alpha (0-1) of
+// the way towards the new value, regardless of the time between them.
+func NewEWMA(alpha float64) *EWMA {
+	return &EWMA{bits: math.Float64bits(math.NaN()), alpha: alpha}
+}
+
+// NewEWMAWithHalfLife makes a new EWMA weighted by time instead of by count: a
+// value's influence halves every d, however many values are added, so the
+// average is meaningful for irregular event streams.
+func NewEWMAWithHalfLife(d time.Duration) *EWMA {
+	return &EWMA{bits: math.Float64bits(math.NaN()), halfLife: d}
+}
+
+// Add a value into the EWMA. The first value sets the average directly.
+func (e *EWMA) Add(val int64) {
+	alpha := e.alpha
+	if e.halfLife > 0 {
+		now := time.Now().UnixNano()
+		elapsed := now - atomic.SwapInt64(&e.last, now)
+		alpha = 1 - math.Exp(-math.Ln2*float64(elapsed)/float64(e.halfLife))
+	}
+
+	for {
+		old := atomic.LoadUint64(&e.bits)
+		avg := math.Float64frombits(old)
+		if math.IsNaN(avg) {
+			avg = float64(val)
+		} else {
+			avg += alpha * (float64(val) - avg)
+		}
+		if atomic.CompareAndSwapUint64(&e.bits, old, math.Float64bits(avg)) {
+			return
+		}
+	}
+}
+
+// Average returns the current decayed average, or 0 if nothing has been
+// added.
+func (e *EWMA) Average() float64 {
+	avg := math.Float64frombits(atomic.LoadUint64(&e.bits))
+	if math.IsNaN(avg) {
+		return 0
+	}
+	return avg
+}
+
+// String returns Average() as a string (to implement expvar.Var)
+func (e *EWMA) String() string {
+	return strconv.FormatFloat(e.Average(), 'f', -1, 64)
+}
@@ -0,0 +1,39 @@
+package exphttp
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEWMAConverges(t *testing.T) {
+	e := NewEWMA(0.1)
+	if got := e.Average(); got != 0 {
+		t.Errorf("empty Average() = %v, want 0", got)
+	}
+
+	e.Add(1000)
+	if got := e.Average(); got != 1000 {
+		t.Errorf("Average() = %v after the first value, want 1000", got)
+	}
+
+	// after a step to 100, the gap shrinks by (1-alpha) per value
+	for i := 0; i < 50; i++ {
+		e.Add(100)
+	}
+	want := 100 + 900*math.Pow(0.9, 50)
+	if got := e.Average(); math.Abs(got-want) > 1e-6 {
+		t.Errorf("Average() = %v after 50 values, want %v", got, want)
+	}
+}
+
+func TestEWMAHalfLife(t *testing.T) {
+	e := NewEWMAWithHalfLife(time.Hour)
+	e.Add(1000)
+
+	// barely any time passes, so the new value has almost no weight
+	e.Add(0)
+	if got := e.Average(); got < 999 {
+		t.Errorf("Average() = %v right after the first value, want about 1000", got)
+	}
+}
@@ -0,0 +1,138 @@
+package exphttp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// metadataRegistry tracks which metric families have had their HELP and TYPE
+// lines written in the current exposition, so each appears exactly once.
+type metadataRegistry struct {
+	emitted map[string]bool
+}
+
+// reset forgets all emitted families, at the start of a new exposition.
+func (m *metadataRegistry) reset() {
+	m.emitted = make(map[string]bool)
+}
+
+// once returns true the first time it is called for family after a reset.
+func (m *metadataRegistry) once(family string) bool {
+	if m.emitted == nil {
+		m.emitted = make(map[string]bool)
+	}
+	if m.emitted[family] {
+		return false
+	}
+	m.emitted[family] = true
+	return true
+}
+
+// promWriter writes Prometheus text exposition lines, emitting HELP/TYPE
+// metadata once per family and keeping track of bytes written and the first
+// error encountered.
+type promWriter struct {
+	w    io.Writer
+	meta *metadataRegistry
+	help map[string]string
+	n    int64
+	err  error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += int64(n)
+	p.err = err
+}
+
+// sample writes a single sample of family, with optional pre-formatted labels
+// (e.g. `code="200"`).
+func (p *promWriter) sample(family, typ, labels string, val interface{}) {
+	p.series(family, family, typ, labels, val)
+}
+
+// series writes a single sample named name, which differs from its family for
+// the _bucket, _sum and _count series of a histogram.
+func (p *promWriter) series(family, name, typ, labels string, val interface{}) {
+	if p.meta.once(family) {
+		help, ok := p.help[family]
+		if !ok {
+			help = "exphttp metric " + family
+		}
+		p.printf("# HELP %s %s\n", family, help)
+		p.printf("# TYPE %s %s\n", family, typ)
+	}
+	if labels != "" {
+		p.printf("%s{%s} %v\n", name, labels, val)
+	} else {
+		p.printf("%s %v\n", name, val)
+	}
+}
+
+// promLabel formats a label pair, escaping the value as the text format
+// requires.
+func promLabel(name, val string) string {
+	return name + `="` + promLabelEscaper.Replace(val) + `"`
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promName converts a dotted expvar key into a valid Prometheus metric name.
+func promName(parts ...string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		}
+		return '_'
+	}, strings.Join(parts, "_"))
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// WriteTo writes the most recently fetched vars to w in the Prometheus text
+// exposition format, using the same keys as the MemStats, HTTPStats and
+// RPCStats methods. HELP and TYPE lines are emitted exactly once per metric
+// family per call, with help text taken from Help when present.
+func (x *ExpPoller) WriteTo(w io.Writer) (int64, error) {
+	x.meta.reset()
+	p := &promWriter{w: w, meta: &x.meta, help: x.Help}
+
+	saved := x.RecordFunc
+	x.unfilter = true
+	defer func() { x.RecordFunc, x.unfilter = saved, false }()
+	x.RecordFunc = func(key string, val interface{}) {
+		typ := "gauge"
+		if isCounterKey(key, x.sep()) {
+			typ = "counter"
+		}
+		p.sample(promName(x.PluginName, key), typ, "", val)
+	}
+
+	var err error
+	if _, ok := x.Vars["memstats"]; ok {
+		err = x.MemStats()
+	}
+	if err == nil {
+		err = x.HTTPStats()
+	}
+	if err == nil {
+		err = x.RPCStats()
+	}
+	if err == nil {
+		err = x.PoolStats()
+	}
+	if err == nil {
+		err = x.writeBuildInfo(p)
+	}
+	if err == nil {
+		err = p.err
+	}
+	return p.n, err
+}
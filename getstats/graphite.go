@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pbnjay/exphttp"
+)
+
+// graphiteRecordFunc writes each value as a Graphite plaintext line to the
+// carbon receiver at addr, e.g. "prod1.main.memstats.heap_alloc 123 1500000000".
+//
+// The connection is opened on the first value of a poll. If a write fails the
+// connection is dropped and the rest of that poll is skipped, and a new
+// connection is attempted on the next poll.
+func graphiteRecordFunc(poller *exphttp.ExpPoller, instance, addr string) func(string, interface{}) {
+	// dots in the host and instance would add path levels
+	prefix := strings.ReplaceAll(graphiteName(*hostName), ".", "_") + "."
+	if instance != "" {
+		prefix += strings.ReplaceAll(graphiteName(strings.TrimPrefix(instance, "-")), ".", "_") + "."
+	}
+
+	var conn net.Conn
+	var failedAt time.Time
+	return func(key string, value interface{}) {
+		if failedAt.Equal(poller.FetchTime) {
+			return
+		}
+		val, ok := formatValue(value)
+		if !ok {
+			return
+		}
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", addr, 5*time.Second)
+			if err != nil {
+				log.Println("getstats: graphite:", err)
+				failedAt = poller.FetchTime
+				return
+			}
+			conn = c
+		}
+
+		_, err := fmt.Fprintf(conn, "%s%s.%s %s %d\n", prefix,
+			graphiteName(poller.PluginName), graphiteName(key), val, poller.FetchTime.Unix())
+		if err != nil {
+			log.Println("getstats: graphite:", err)
+			conn.Close()
+			conn = nil
+			failedAt = poller.FetchTime
+		}
+	}
+}
+
+// graphiteName replaces the characters that Graphite treats specially in a
+// metric path component.
+func graphiteName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '/', '\t', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+
+	"github.com/pbnjay/exphttp"
+)
+
+// jsonLine is a single metric as printed by -format json.
+type jsonLine struct {
+	Host   string      `json:"host"`
+	Plugin string      `json:"plugin"`
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Time   int64       `json:"time"`
+}
+
+// jsonRecordFunc writes each value to w as a JSON object on its own line, e.g.
+//
+//	{"host":"prod1","plugin":"memstats-main","key":"heap_alloc","value":123,"time":1500000000}
+//
+// Values keep their native type, so integers are printed in full and floats
+// with all their precision.
+func jsonRecordFunc(poller *exphttp.ExpPoller, instance string, w io.Writer) func(string, interface{}) {
+	enc := json.NewEncoder(w)
+	return func(key string, value interface{}) {
+		err := enc.Encode(jsonLine{
+			Host:   *hostName,
+			Plugin: poller.PluginName + instance,
+			Key:    key,
+			Value:  value,
+			Time:   poller.FetchTime.UTC().Unix(),
+		})
+		if err != nil {
+			log.Println("getstats: json:", err)
+		}
+	}
+}
@@ -10,51 +10,145 @@
 //        Exec "user:group" "/path/to/getstats" "-h" "prod1" "-i main" "-u" "http://127.0.0.1:3000/debug/vars"
 //     </Plugin>
 //
+// Several endpoints can be polled by repeating -u, with a matching -i for each
+// (otherwise the instance names come from the URLs' host and port):
+//     Exec "user:group" "/path/to/getstats" "-h" "prod1" "-u" "http://127.0.0.1:3000/debug/vars" "-u" "http://127.0.0.1:3001/debug/vars"
+//
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pbnjay/exphttp"
 )
 
 var (
-	instanceName  = flag.String("i", "", "instance name to use")
+	instanceNames stringList
+	baseURLs      stringList
 	hostName      = flag.String("h", "", "hostname to use")
-	baseURL       = flag.String("u", "http://127.0.0.1:9000/debug/vars", "expvar URL to use")
 	watchInterval = flag.Duration("w", time.Second*10, "watch interval to use")
+	fetchRetries  = flag.Int("r", 2, "number of retries on network errors")
+	keySeparator  = flag.String("s", ".", "key separator used by the polled process")
+	outputFormat  = flag.String("format", "collectd", "output format: collectd, statsd, graphite or json")
+	statsdAddr    = flag.String("statsd", "127.0.0.1:8125", "StatsD host:port for -format statsd")
+	graphiteAddr  = flag.String("graphite", "127.0.0.1:2003", "carbon host:port for -format graphite")
 )
 
+func init() {
+	flag.Var(&instanceNames, "i", "instance name to use (repeat once per -u)")
+	flag.Var(&baseURLs, "u", "expvar URL to use, may be repeated (default http://127.0.0.1:9000/debug/vars)")
+}
+
+// stringList is a flag.Value that collects every use of a repeated flag.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 func main() {
 	*hostName, _ = os.Hostname()
 	flag.Parse()
 
-	opts := fmt.Sprintf("interval=%d", int(watchInterval.Seconds()))
+	if len(baseURLs) == 0 {
+		baseURLs = stringList{"http://127.0.0.1:9000/debug/vars"}
+	}
+	if len(instanceNames) > 0 && len(instanceNames) != len(baseURLs) {
+		log.Fatalf("getstats: %d -i names given for %d -u URLs", len(instanceNames), len(baseURLs))
+	}
 
-	if *instanceName != "" {
-		*instanceName = "-" + *instanceName
+	// each endpoint polls on its own goroutine, so one being down doesn't
+	// delay or skip the others
+	var wg sync.WaitGroup
+	for i, u := range baseURLs {
+		instance := instanceFor(i, u)
+		if instance != "" {
+			instance = "-" + instance
+		}
+		poller, err := newPoller(u, instance)
+		if err != nil {
+			log.Fatal("getstats: ", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			poller.Run(context.Background(), *watchInterval)
+		}()
 	}
+	wg.Wait()
+}
 
-	poller := exphttp.ExpPoller{
-		BaseURL: *baseURL,
+// instanceFor returns the instance name for the i'th URL: the matching -i
+// name if any were given, otherwise nothing for a single URL, or the URL's
+// host and port when polling several.
+func instanceFor(i int, rawURL string) string {
+	if len(instanceNames) > 0 {
+		return instanceNames[i]
+	}
+	if len(baseURLs) == 1 {
+		return ""
 	}
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		return strings.NewReplacer(".", "_", ":", "_").Replace(u.Host)
+	}
+	return strconv.Itoa(i)
+}
 
-	poller.RecordFunc = func(key string, value interface{}) {
-		fmt.Printf("PUTVAL %s/%s%s/gauge-%s %s %d:%v\n",
-			*hostName, poller.PluginName, *instanceName,
-			key, opts, poller.FetchTime.UTC().Unix(), value)
+// newPoller makes a poller for baseURL that writes in the -format output,
+// with instance appended to its plugin names.
+func newPoller(baseURL, instance string) (*exphttp.ExpPoller, error) {
+	poller := &exphttp.ExpPoller{
+		BaseURL:      baseURL,
+		Separator:    *keySeparator,
+		FetchRetries: *fetchRetries,
 	}
 
-	for {
-		if poller.Fetch() == nil {
-			poller.MemStats()
-			poller.HTTPStats()
-			poller.RPCStats()
+	opts := fmt.Sprintf("interval=%d", int(watchInterval.Seconds()))
+	switch *outputFormat {
+	case "collectd":
+		poller.RecordFunc = collectdRecordFunc(poller, instance, opts)
+	case "statsd":
+		if err := setupStatsd(poller, instance, *statsdAddr); err != nil {
+			return nil, err
 		}
+	case "graphite":
+		poller.RecordFunc = graphiteRecordFunc(poller, instance, *graphiteAddr)
+	case "json":
+		poller.RecordFunc = jsonRecordFunc(poller, instance, os.Stdout)
+	default:
+		return nil, fmt.Errorf("unknown format %q", *outputFormat)
+	}
+	return poller, nil
+}
 
-		time.Sleep(*watchInterval)
+// collectdRecordFunc prints each value as a collectd exec PUTVAL line.
+func collectdRecordFunc(poller *exphttp.ExpPoller, instance, opts string) func(string, interface{}) {
+	return func(key string, value interface{}) {
+		if s, ok := value.(string); ok {
+			// collectd values are numeric, so pass strings (e.g. build info)
+			// through as notifications instead
+			fmt.Printf("PUTNOTIF host=%s plugin=%s%s type_instance=%s time=%d severity=okay message=%q\n",
+				*hostName, poller.PluginName, instance, key, poller.FetchTime.UTC().Unix(), s)
+			return
+		}
+		typ := "gauge"
+		if poller.IsLatencyBucket(key) {
+			typ = "derive"
+		}
+		fmt.Printf("PUTVAL %s/%s%s/%s-%s %s %d:%v\n",
+			*hostName, poller.PluginName, instance,
+			typ, key, opts, poller.FetchTime.UTC().Unix(), value)
 	}
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pbnjay/exphttp"
+)
+
+// statsdPacketSize is the most bytes sent in one UDP packet, to stay well
+// under typical MTUs.
+const statsdPacketSize = 512
+
+// setupStatsd sends each poll's metrics to the StatsD daemon at addr, batched
+// into as few UDP packets as possible. Counters are sent as "|c" increments
+// since the previous poll, and everything else as "|g" gauges.
+func setupStatsd(poller *exphttp.ExpPoller, instance, addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.ReplaceAll(*hostName, ".", "_") + "."
+	if instance != "" {
+		prefix += strings.ReplaceAll(strings.TrimPrefix(instance, "-"), ".", "_") + "."
+	}
+	poller.Deltas = true
+	poller.BatchRecordFunc = func(ts time.Time, metrics map[string]interface{}) {
+		keys := make([]string, 0, len(metrics))
+		for k := range metrics {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var packet []byte
+		for _, k := range keys {
+			val, ok := formatValue(metrics[k])
+			if !ok {
+				continue
+			}
+			typ := "|g"
+			if poller.IsCounter(k) {
+				typ = "|c"
+			}
+			line := prefix + k + ":" + val + typ + "\n"
+			if len(packet) > 0 && len(packet)+len(line) > statsdPacketSize {
+				conn.Write(packet)
+				packet = packet[:0]
+			}
+			packet = append(packet, line...)
+		}
+		if len(packet) > 0 {
+			conn.Write(packet)
+		}
+	}
+	return nil
+}
+
+// formatValue formats a numeric metric value without exponents, returning
+// false for non-numeric values.
+func formatValue(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case int:
+		return strconv.Itoa(v), true
+	}
+	return "", false
+}
@@ -24,11 +24,20 @@
 package exphttp
 
 import (
+	"bufio"
 	"expvar"
-	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -46,27 +55,110 @@ const DefaultGranularity = 32
 // Set to nil to disable before calling NewExpHandler()
 var DefaultLogger = log.New(os.Stderr, "", log.LstdFlags)
 
+// KeySeparator separates the parts of stat keys, e.g. the dots in
+// "responses.200.total_ns". Change it before creating any ExpHandler or
+// ExpRPCServer, for backends that treat dots specially.
+var KeySeparator = "."
+
+// TotalNsRollover is the value at which an ExpHandler's
+// "responses.<code>.total_ns" counters are rolled over, well short of the
+// int64 limit.
+const TotalNsRollover = 1 << 62
+
+// DefaultLatencyBuckets are latency bucket boundaries tuned for typical web
+// requests, for use with ExpHandler.LatencyBuckets.
+var DefaultLatencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+	5 * time.Second, 10 * time.Second,
+}
+
 var expHandlers *expvar.Map
 
+var (
+	handlersMu  sync.Mutex
+	allHandlers []*ExpHandler
+)
+
+// AllHandlers returns every ExpHandler created by NewExpHandler, in creation
+// order. The returned slice is a copy, so it is a stable set to iterate while
+// new handlers are being created.
+func AllHandlers() []*ExpHandler {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	return append([]*ExpHandler(nil), allHandlers...)
+}
+
 // ExpHandlerFunc is a http.HandlerFunc that returns it's own HTTP StatusCode.
 type ExpHandlerFunc func(w http.ResponseWriter, r *http.Request) int
 
 type getStatusCode struct {
 	http.ResponseWriter
-	code int
+	code        int
+	wroteHeader bool
 }
 
+// WriteHeader captures the first final status code. Informational 1xx codes
+// (other than 101 Switching Protocols) may precede it, and later calls are
+// ignored by net/http.
 func (w *getStatusCode) WriteHeader(c int) {
-	w.code = c
+	if !w.wroteHeader && (c >= 200 || c == http.StatusSwitchingProtocols) {
+		w.code = c
+		w.wroteHeader = true
+	}
 	w.ResponseWriter.WriteHeader(c)
 }
 
+// Flush implements http.Flusher if the underlying writer does.
+func (w *getStatusCode) Flush() { flushWriter(w.ResponseWriter) }
+
+// Hijack implements http.Hijacker if the underlying writer does.
+func (w *getStatusCode) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijackWriter(w.ResponseWriter)
+}
+
+// Push implements http.Pusher if the underlying writer does.
+func (w *getStatusCode) Push(target string, opts *http.PushOptions) error {
+	return pushWriter(w.ResponseWriter, target, opts)
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (w *getStatusCode) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// flushWriter, hijackWriter and pushWriter forward the optional
+// http.ResponseWriter interfaces through the wrappers in this package, so
+// that wrapped handlers can still stream, upgrade connections and push.
+// Hijack and Push return http.ErrNotSupported when w doesn't support them.
+func flushWriter(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func hijackWriter(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func pushWriter(w http.ResponseWriter, target string, opts *http.PushOptions) error {
+	if p, ok := w.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
 // MakeExpHandlerFunc wraps a http.HandlerFunc so that the response status code
-// is accessible. It is more efficient to update your code to implement
+// is accessible. Handlers that never call WriteHeader are recorded as 200, as
+// net/http sends. It is more efficient to update your code to implement
 // ExpHandlerFunc and return the code directly.
 func MakeExpHandlerFunc(h http.HandlerFunc) ExpHandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) int {
-		w2 := &getStatusCode{w, 500}
+		w2 := &getStatusCode{ResponseWriter: w, code: http.StatusOK}
 		h(w2, r)
 		return w2.code
 	}
@@ -74,6 +166,18 @@ func MakeExpHandlerFunc(h http.HandlerFunc) ExpHandlerFunc {
 
 // ExpHandler is an http.Handler that exposes request/response timing
 // information via the `expvar` stdlib package.
+//
+// Responses are counted per status code in "responses.<code>", and per
+// status class in "responses.2xx" etc, each with a "total_ns" latency sum.
+// The "in_flight" gauge is the number of requests currently being handled.
+//
+// The "responses.<code>.total_ns" counters hold cumulative latency in int64
+// nanoseconds, about 292 years' worth. A hot endpoint with 1000 requests in
+// flight on average (e.g. 10k req/s at 100ms) accumulates that in about 107
+// days, so each total is rolled back by TotalNsRollover when it exceeds it,
+// and the rollovers are counted in "responses.<code>.total_ns_rollovers".
+// ExpPoller accounts for these when computing averages. The class totals
+// are rolled over the same way.
 type ExpHandler struct {
 	// Name of the handler/endpoint.
 	Name string
@@ -88,12 +192,227 @@ type ExpHandler struct {
 	// HandlerFunc is the ExpHandlerFunc that is tracked.
 	HandlerFunc ExpHandlerFunc
 
-	// Log requests to this logger if non-nil.
+	// Log requests to this logger if non-nil. Panics are logged here too,
+	// unless PanicLog is set.
 	Log *log.Logger
 
-	didInit      bool
+	// PanicLog, if non-nil, receives panic reports instead of Log, so that
+	// panics can still be logged with Log set to nil to silence the
+	// per-request lines.
+	PanicLog *log.Logger
+
+	// SlowThreshold, if non-zero, only logs requests that took longer than
+	// this to Log, and counts them in "responses.slow". All requests are
+	// still recorded in the other stats.
+	SlowThreshold time.Duration
+
+	// RecordProcessTime also records "responses.<code>.process_ns", the time
+	// from when the request body was fully read until the handler returned.
+	// This separates server processing time from client upload speed. If the
+	// handler never reads the body to EOF, process_ns equals total_ns.
+	RecordProcessTime bool
+
+	// LatencyBuckets, if non-nil, enables cumulative latency bucket counters
+	// with these (ascending) upper bounds, published as "latency.le_5ms" etc.
+	// plus "latency.le_inf". Each counts the requests that completed within
+	// its bound, so they can be graphed as collectd derive counters. Set to
+	// DefaultLatencyBuckets for sensible web defaults. Only parsed once in the
+	// first incoming request.
+	LatencyBuckets []time.Duration
+
+	// ResponseHistogram, if non-nil, records a latency Histogram per status
+	// code with these bucket bounds in ns, e.g. []int64{1e6, 5e6, 1e7, 5e7},
+	// published as "responses.<code>.histogram".
+	ResponseHistogram []int64
+
+	// LatencyHdrSigFigs, if non-zero, also records every request's latency in
+	// an HdrHistogram with this many significant digits (1-5), for accurate
+	// arbitrary quantiles. It is published as "latency_hdr", with the count,
+	// sum, max and p50/p90/p99/p99_9 in ns, and can be queried with
+	// LatencySnapshot. The count and sum are polled as counters, the max and
+	// quantiles as gauges. Only parsed once in the first incoming request.
+	LatencyHdrSigFigs int
+
+	// LatencyHdrMax is the largest latency tracked by LatencyHdrSigFigs,
+	// slower requests being recorded as this. Defaults to a minute if zero.
+	LatencyHdrMax time.Duration
+
+	// HostStats enables per-virtual-host counts, bucketed by the TLS server
+	// name (SNI) or else the Host header, as "host.<host>.requests" and
+	// "host.<host>.responses". Dots in host names become underscores.
+	HostStats bool
+
+	// HostAllowList, if non-empty, limits HostStats to these hosts, with all
+	// others counted under "host.other".
+	HostAllowList []string
+
+	// MaxHosts caps the number of distinct hosts tracked by HostStats when
+	// there's no HostAllowList, evicting the least recently seen host when
+	// full. Defaults to 100 if zero. Only parsed once in the first incoming
+	// request.
+	MaxHosts int
+
+	// TenantFunc, if non-nil, enables per-tenant stats for multi-tenant
+	// services, recorded as "tenant.<id>.requests", "tenant.<id>.responses"
+	// and "tenant.<id>.responses.total_ns" using the identifier it returns
+	// for each request. The total is rolled over like the other total_ns
+	// counters. Dots in identifiers become underscores, and an empty
+	// identifier is counted under "tenant.other".
+	TenantFunc func(r *http.Request) string
+
+	// MaxTenants caps the number of distinct tenants tracked by TenantFunc,
+	// evicting the least recently seen tenant when full. Defaults to 100 if
+	// zero. Only parsed once in the first incoming request.
+	MaxTenants int
+
+	// PerMethod enables per-HTTP-method stats, recorded as
+	// "requests.<METHOD>", "responses.<METHOD>.<code>" and
+	// "responses.<METHOD>.<code>.total_ns" alongside the aggregate counts.
+	// Methods other than the standard ones (GET, POST, etc) are counted under
+	// "OTHER".
+	PerMethod bool
+
+	// PathLabel, if non-nil, enables per-route stats for handlers serving a
+	// subtree, recorded as "responses.<label>.<code>" and
+	// "responses.<label>.<code>.total_ns" using the label it returns for each
+	// request, e.g. a route pattern. Labels are lowercased and dots become
+	// underscores. At most 256 distinct labels are tracked, with the rest
+	// (and empty ones) counted under "responses.other.<code>". Only parsed
+	// once in the first incoming request.
+	PathLabel func(r *http.Request) string
+
+	// UserAgentStats enables coarse per-client-type counts, recorded as
+	// "ua.<family>.requests" using UAClassifier. At most 16 distinct families
+	// are tracked, with the rest counted under "ua.other".
+	UserAgentStats bool
+
+	// UAClassifier maps a User-Agent header to a small, fixed set of
+	// families. Defaults to DefaultUAClassifier if nil.
+	UAClassifier func(ua string) string
+
+	// HTTP2Stats enables HTTP/2 specific stats: "h2.requests", the
+	// "h2.active_requests" gauge of in-progress HTTP/2 requests, and
+	// "h2.pushes" counting server pushes made through http.Pusher. HTTP/1
+	// requests are unaffected. Only parsed once in the first incoming request.
+	HTTP2Stats bool
+
+	// TrackSlowest publishes "slowest" with the method, path and time of the
+	// slowest request, alongside its elapsed time in "max_ns". Only parsed
+	// once in the first incoming request.
+	TrackSlowest bool
+
+	// MaxResetInterval, if non-zero, resets "max_ns" and "slowest" every
+	// interval so that a one-off slow request doesn't pin them forever. Only
+	// parsed once in the first incoming request.
+	MaxResetInterval time.Duration
+
+	// RePanic re-panics with the original value after recording a panic,
+	// instead of writing a 500 response, so that outer middleware or
+	// net/http itself can handle it. The in-flight gauge is still
+	// decremented.
+	RePanic bool
+
+	// PanicLogInterval limits panic logging to the first panic in each
+	// interval, followed by a summary of how many more were suppressed. All
+	// panics are still counted in "panics". Zero (the default) logs every
+	// panic.
+	PanicLogInterval time.Duration
+
+	// AsyncBuffer, if non-zero, enables async recording: per-request stats are
+	// sent on a channel of this size and aggregated by a background goroutine,
+	// so the request path only does a single channel send. In this mode
+	// "requests" is counted when a request completes rather than when it
+	// starts. Only parsed once in the first incoming request.
+	AsyncBuffer int
+
+	// AsyncBlock makes requests wait for room when the async channel is full.
+	// By default stats are dropped instead, and counted in "stats.dropped".
+	AsyncBlock bool
+
+	// InFlightWindow, if non-zero, publishes "in_flight.avg" and
+	// "in_flight.max" of the "in_flight" gauge over this window. The count is
+	// sampled each time it changes, so the average and max capture spikes
+	// between polls that the gauge alone would miss. Only parsed once in the
+	// first incoming request.
+	InFlightWindow time.Duration
+
+	// RecordHeaders enables tracking of request header sizes, exposed as the
+	// "request_header_bytes" and "request_header_count" averages over the last
+	// minute. Only parsed once in the first incoming request.
+	RecordHeaders bool
+
+	// LargeHeaderBytes is the total header size above which a request is
+	// counted in "requests.large_headers". Zero disables the counter. Only
+	// used when RecordHeaders is true.
+	LargeHeaderBytes int
+
+	// RecordBodyPresence counts requests carrying a body (ContentLength > 0,
+	// or a chunked body of unknown length) in "requests.with_body", and all
+	// others in "requests.empty". Only parsed once in the first incoming
+	// request.
+	RecordBodyPresence bool
+
+	// RecordBodySizes counts request and response body bytes in
+	// "requests.bytes" and "responses.bytes". Request sizes come from the
+	// Content-Length, or for chunked bodies the bytes the handler reads.
+	// Only parsed once in the first incoming request.
+	RecordBodySizes bool
+
+	// AllocSampleRate, if non-zero, measures heap allocations for one in every
+	// AllocSampleRate requests, exposed as the "allocs" average over the last
+	// minute. This is expensive and approximate: runtime.ReadMemStats stops
+	// the world on every sampled request, and the malloc count is process-wide
+	// so concurrent requests and background goroutines are included in the
+	// figure. Use it to spot regressions on a quiet instance, not in the hot
+	// path of a busy one. Only parsed once in the first incoming request.
+	AllocSampleRate int
+
+	// RecentRequests, if non-zero, keeps the start times of the last
+	// RecentRequests requests, published as "recent_requests" (a JSON array of
+	// unix nanosecond timestamps, oldest first). This is a troubleshooting aid
+	// for checking requests_per_* against the true rate; memory use is fixed
+	// at 8 bytes per entry. With AsyncBuffer the arrival times are still
+	// recorded, but in completion order. Only parsed once in the first
+	// incoming request.
+	RecentRequests int
+
+	// RecentPanics, if non-zero, keeps the value and stack trace of the last
+	// RecentPanics panics, published as "recent_panics" (a JSON array of
+	// objects, oldest first). Each stack is truncated to 8KB. Only parsed
+	// once in the first incoming request.
+	RecentPanics int
+
+	disabled     int32
+	initOnce     sync.Once
 	reqCounters  []*RateCounter
 	respCounters []*RateCounter
+	headerBytes  *MovingAverage
+	headerCount  *MovingAverage
+	async        chan requestStats
+	allocs       *MovingAverage
+	allocSeq     int64
+	recent       *timestampRing
+	panics       *panicRing
+	bodyPresence bool
+	bodySizes    bool
+	panicLog     panicLimiter
+	sep          string
+	codeKeys     map[int][2]string
+	classKeys    [6][2]string
+	latency      []*expvar.Int
+	latencyHdr   *HdrHistogram
+	codeHists    sync.Map
+	nowFunc      func() time.Time
+	slowest      SlowestRequest
+	h2Active     int64
+	inFlight     int64
+	inFlightDist *MovingAverage
+	h2Stats      bool
+	uaFamilies   *labelCap
+	pathLabels   *labelCap
+	hosts        *labelLRU
+	tenants      *labelLRU
+	allowedHosts map[string]bool
 }
 
 // NewExpHandler creates a new ExpHandler, publishes a new expvar.Map to track
@@ -110,13 +429,83 @@ func NewExpHandler(name string, h ExpHandlerFunc) *ExpHandler {
 		Durations:   map[string]time.Duration{"min": time.Minute},
 		HandlerFunc: h,
 		Log:         DefaultLogger,
+
+		sep:     KeySeparator,
+		nowFunc: time.Now,
 	}
 
 	expHandlers.Add(name, 1)
+
+	handlersMu.Lock()
+	allHandlers = append(allHandlers, e)
+	handlersMu.Unlock()
 	return e
 }
 
+// SetEnabled turns stats recording on or off for this handler. When disabled,
+// ServeHTTP skips all recording and logging and just calls HandlerFunc. It is
+// safe to call at any time (e.g. from an admin endpoint) since the flag is
+// read with an atomic load on every request. Handlers are enabled by default.
+func (e *ExpHandler) SetEnabled(enabled bool) {
+	var v int32
+	if !enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&e.disabled, v)
+}
+
+// Enabled returns true if stats recording is enabled for this handler.
+func (e *ExpHandler) Enabled() bool {
+	return atomic.LoadInt32(&e.disabled) == 0
+}
+
+// TrackCodes pre-registers the "responses.<code>" and "responses.<code>.total_ns"
+// stats at zero for each of the codes given, so that the series exist from
+// startup instead of appearing on first occurrence.
+func (e *ExpHandler) TrackCodes(codes ...int) {
+	for _, code := range codes {
+		c := strconv.Itoa(code)
+		e.Stats.Add(e.key("responses", c), 0)
+		e.Stats.Add(e.key("responses", c, "total_ns"), 0)
+	}
+}
+
+// now returns the current time from nowFunc, which tests may replace with a
+// controllable clock.
+func (e *ExpHandler) now() time.Time {
+	if e.nowFunc != nil {
+		return e.nowFunc()
+	}
+	return time.Now()
+}
+
+// separator returns the handler's key separator, falling back to
+// KeySeparator for handlers not made by NewExpHandler.
+func (e *ExpHandler) separator() string {
+	if e.sep != "" {
+		return e.sep
+	}
+	return KeySeparator
+}
+
+// key joins parts of a stat key with the handler's separator.
+func (e *ExpHandler) key(parts ...string) string {
+	return strings.Join(parts, e.separator())
+}
+
+// init sets up the stats enabled by the configuration fields. It must only
+// be called through initOnce.
 func (e *ExpHandler) init() {
+	e.codeKeys = make(map[int][2]string)
+	for _, code := range []int{http.StatusOK, http.StatusBadRequest, http.StatusUnauthorized, http.StatusInternalServerError} {
+		c := strconv.Itoa(code)
+		e.codeKeys[code] = [2]string{e.key("responses", c), e.key("responses", c, "total_ns")}
+	}
+	for class := 1; class < len(e.classKeys); class++ {
+		c := strconv.Itoa(class) + "xx"
+		e.classKeys[class] = [2]string{e.key("responses", c), e.key("responses", c, "total_ns")}
+	}
+
 	e.reqCounters = make([]*RateCounter, 0, len(e.Durations))
 	e.respCounters = make([]*RateCounter, 0, len(e.Durations))
 
@@ -128,69 +517,680 @@ func (e *ExpHandler) init() {
 		e.reqCounters = append(e.reqCounters, r1)
 		e.respCounters = append(e.respCounters, r2)
 	}
-	e.didInit = true
+
+	e.Stats.Set("in_flight", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&e.inFlight)
+	}))
+	if e.InFlightWindow > 0 {
+		e.inFlightDist = NewMovingAverage(e.InFlightWindow)
+		e.Stats.Set(e.key("in_flight", "avg"), e.inFlightDist)
+		e.Stats.Set(e.key("in_flight", "max"), expvar.Func(func() interface{} {
+			return e.inFlightDist.Max()
+		}))
+	}
+	if e.RecordHeaders {
+		e.headerBytes = NewMovingAverage(time.Minute)
+		e.headerCount = NewMovingAverage(time.Minute)
+		e.Stats.Set("request_header_bytes", e.headerBytes)
+		e.Stats.Set("request_header_count", e.headerCount)
+		if e.LargeHeaderBytes > 0 {
+			e.Stats.Add(e.key("requests", "large_headers"), 0)
+		}
+	}
+	if e.LatencyBuckets != nil {
+		e.latency = make([]*expvar.Int, len(e.LatencyBuckets)+1)
+		for i := range e.latency {
+			label := "le_inf"
+			if i < len(e.LatencyBuckets) {
+				label = "le_" + durationLabel(e.LatencyBuckets[i])
+			}
+			e.latency[i] = new(expvar.Int)
+			e.Stats.Set(e.key("latency", label), e.latency[i])
+		}
+	}
+	if e.LatencyHdrSigFigs > 0 {
+		max := e.LatencyHdrMax
+		if max <= 0 {
+			max = time.Minute
+		}
+		e.latencyHdr = NewHdrHistogram(max.Nanoseconds(), e.LatencyHdrSigFigs)
+		e.Stats.Set("latency_hdr", e.latencyHdr)
+	}
+	if e.PathLabel != nil {
+		e.pathLabels = newLabelCap(256)
+	}
+	if e.UserAgentStats {
+		e.uaFamilies = newLabelCap(16)
+		if e.UAClassifier == nil {
+			e.UAClassifier = DefaultUAClassifier
+		}
+	}
+	if e.HTTP2Stats {
+		e.h2Stats = true
+		e.Stats.Add(e.key("h2", "requests"), 0)
+		e.Stats.Add(e.key("h2", "pushes"), 0)
+		e.Stats.Set(e.key("h2", "active_requests"), expvar.Func(func() interface{} {
+			return atomic.LoadInt64(&e.h2Active)
+		}))
+	}
+	e.Stats.Set("max_ns", &e.slowest)
+	if e.TrackSlowest {
+		e.slowest.Details = true
+		e.Stats.Set("slowest", slowestDetails{&e.slowest})
+	}
+	if e.MaxResetInterval > 0 {
+		go func() {
+			for range time.Tick(e.MaxResetInterval) {
+				e.slowest.Reset()
+			}
+		}()
+	}
+	if e.HostStats {
+		if len(e.HostAllowList) > 0 {
+			e.allowedHosts = make(map[string]bool, len(e.HostAllowList))
+			for _, h := range e.HostAllowList {
+				e.allowedHosts[sanitizeLabel(stripPort(h), e.separator())] = true
+			}
+		} else {
+			max := e.MaxHosts
+			if max <= 0 {
+				max = 100
+			}
+			e.hosts = newLabelLRU(max, func(host string) {
+				e.Stats.Delete(e.key("host", host, "requests"))
+				e.Stats.Delete(e.key("host", host, "responses"))
+			})
+		}
+	}
+	if e.TenantFunc != nil {
+		max := e.MaxTenants
+		if max <= 0 {
+			max = 100
+		}
+		e.tenants = newLabelLRU(max, func(tenant string) {
+			e.Stats.Delete(e.key("tenant", tenant, "requests"))
+			e.Stats.Delete(e.key("tenant", tenant, "responses"))
+			e.Stats.Delete(e.key("tenant", tenant, "responses", "total_ns"))
+			e.Stats.Delete(e.key("tenant", tenant, "responses", "total_ns_rollovers"))
+		})
+	}
+	if e.AllocSampleRate > 0 {
+		e.allocs = NewMovingAverage(time.Minute)
+		e.Stats.Set("allocs", e.allocs)
+	}
+	if e.RecordBodyPresence {
+		e.bodyPresence = true
+		e.Stats.Add(e.key("requests", "with_body"), 0)
+		e.Stats.Add(e.key("requests", "empty"), 0)
+	}
+	if e.RecordBodySizes {
+		e.bodySizes = true
+		e.Stats.Add(e.key("requests", "bytes"), 0)
+		e.Stats.Add(e.key("responses", "bytes"), 0)
+	}
+	if e.RecentRequests > 0 {
+		e.recent = newTimestampRing(e.RecentRequests)
+		e.Stats.Set("recent_requests", e.recent)
+	}
+	if e.RecentPanics > 0 {
+		e.panics = newPanicRing(e.RecentPanics)
+		e.Stats.Set("recent_panics", e.panics)
+	}
+	if e.AsyncBuffer > 0 {
+		e.async = make(chan requestStats, e.AsyncBuffer)
+		e.Stats.Add(e.key("stats", "dropped"), 0)
+		go e.runAsync()
+	}
+}
+
+func (e *ExpHandler) recordHeaders(r *http.Request) {
+	size, count := 0, 0
+	for name, vals := range r.Header {
+		for _, v := range vals {
+			size += len(name) + len(v)
+			count++
+		}
+	}
+	e.headerBytes.Add(int64(size))
+	e.headerCount.Add(int64(count))
+	if e.LargeHeaderBytes > 0 && size > e.LargeHeaderBytes {
+		e.Stats.Add(e.key("requests", "large_headers"), 1)
+	}
+}
+
+// panicLogger returns the logger for panic reports, or nil to skip them.
+func (e *ExpHandler) panicLogger() *log.Logger {
+	if e.PanicLog != nil {
+		return e.PanicLog
+	}
+	return e.Log
+}
+
+// panicLimiter deduplicates panic logging so a handler panicking in a tight
+// loop doesn't flood the logs.
+type panicLimiter struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+	flushing   bool
+}
+
+func (p *panicLimiter) log(l *log.Logger, interval time.Duration, v interface{}, stack []byte) {
+	if interval <= 0 {
+		l.Printf("caught panic: %v\n%s", v, stack)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.Sub(p.last) >= interval {
+		p.last = now
+		l.Printf("caught panic: %v\n%s", v, stack)
+		return
+	}
+	p.suppressed++
+	if !p.flushing {
+		p.flushing = true
+		time.AfterFunc(p.last.Add(interval).Sub(now), func() { p.flush(l) })
+	}
+}
+
+func (p *panicLimiter) flush(l *log.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.suppressed > 0 {
+		l.Println("caught", p.suppressed, "more panics")
+	}
+	p.suppressed = 0
+	p.flushing = false
+	p.last = time.Now()
+}
+
+// DefaultUAClassifier maps a User-Agent to one of "bot", "sdk", "browser" or
+// "other" by looking for well-known substrings.
+func DefaultUAClassifier(ua string) string {
+	ua = strings.ToLower(ua)
+	for _, f := range uaFamilies {
+		for _, sub := range f.subs {
+			if strings.Contains(ua, sub) {
+				return f.family
+			}
+		}
+	}
+	return "other"
+}
+
+// uaFamilies are checked in order, so bots pretending to be browsers ("Mozilla/5.0
+// (compatible; Googlebot/2.1)") are caught first.
+var uaFamilies = []struct {
+	family string
+	subs   []string
+}{
+	{"bot", []string{"bot", "crawler", "spider", "slurp"}},
+	{"sdk", []string{"curl", "wget", "python", "go-http-client", "okhttp", "axios", "java", "node-fetch"}},
+	{"browser", []string{"mozilla", "chrome", "safari", "firefox", "edge", "opera"}},
+}
+
+// ResetMax clears the slowest request stats ("max_ns" and "slowest") and
+// returns the elapsed time of the slowest request since the last reset.
+// Calling this from each scrape gives reset-on-read semantics.
+func (e *ExpHandler) ResetMax() int64 {
+	return e.slowest.Reset()
+}
+
+// codeHistogram returns the ResponseHistogram for code, creating and
+// publishing it if needed.
+func (e *ExpHandler) codeHistogram(code int) *Histogram {
+	if h, ok := e.codeHists.Load(code); ok {
+		return h.(*Histogram)
+	}
+	h, loaded := e.codeHists.LoadOrStore(code, NewHistogram(e.ResponseHistogram))
+	if !loaded {
+		e.Stats.Set(e.key("responses", strconv.Itoa(code), "histogram"), h.(*Histogram))
+	}
+	return h.(*Histogram)
+}
+
+// LatencySnapshot returns a snapshot of the LatencyHdrSigFigs histogram, or
+// nil if it isn't enabled (or no request has been seen yet).
+func (e *ExpHandler) LatencySnapshot() *HdrSnapshot {
+	if e.latencyHdr == nil {
+		return nil
+	}
+	return e.latencyHdr.Snapshot()
+}
+
+// hostLabel returns the bucket for r under HostStats.
+func (e *ExpHandler) hostLabel(r *http.Request) string {
+	host := r.Host
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		host = r.TLS.ServerName
+	}
+	host = sanitizeLabel(stripPort(host), e.separator())
+	if e.allowedHosts != nil {
+		if !e.allowedHosts[host] {
+			return "other"
+		}
+		return host
+	}
+	e.hosts.touch(host)
+	return host
+}
+
+// hasBody returns true if r carries a request body.
+func hasBody(r *http.Request) bool {
+	if r.ContentLength > 0 {
+		return true
+	}
+	return r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody
+}
+
+// methodLabel returns method if it is a standard HTTP method, otherwise
+// "OTHER", so that bogus methods can't create new stats.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// durationLabel formats d for use in a key, using the largest whole unit so
+// that no separator characters appear, e.g. "5ms", "2500ms" or "500us".
+func durationLabel(d time.Duration) string {
+	switch {
+	case d%time.Millisecond == 0:
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+	case d%time.Microsecond == 0:
+		return strconv.FormatInt(int64(d/time.Microsecond), 10) + "us"
+	}
+	return strconv.FormatInt(int64(d), 10) + "ns"
+}
+
+// requestStats is everything recorded about a single completed request.
+type requestStats struct {
+	method   string
+	url      *url.URL
+	code     int
+	elapsed  int64
+	panicked bool
+
+	timedBody bool
+	process   int64
+	host      string
+	tenant    string
+	verb      string
+	path      string
+	arrival   time.Time
+
+	sized     bool
+	reqBytes  int64
+	respBytes int64
+}
+
+// h2Writer wraps an HTTP/2 http.ResponseWriter to count server pushes.
+type h2Writer struct {
+	http.ResponseWriter
+	e *ExpHandler
+}
+
+// Flush implements http.Flusher if the underlying writer does.
+func (w *h2Writer) Flush() { flushWriter(w.ResponseWriter) }
+
+// Hijack implements http.Hijacker if the underlying writer does.
+func (w *h2Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijackWriter(w.ResponseWriter)
+}
+
+// Push implements http.Pusher, counting successful pushes.
+func (w *h2Writer) Push(target string, opts *http.PushOptions) error {
+	err := pushWriter(w.ResponseWriter, target, opts)
+	if err == nil {
+		w.e.Stats.Add(w.e.key("h2", "pushes"), 1)
+	}
+	return err
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (w *h2Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// sizeWriter wraps an http.ResponseWriter to count the body bytes written.
+type sizeWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *sizeWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher if the underlying writer does.
+func (w *sizeWriter) Flush() { flushWriter(w.ResponseWriter) }
+
+// Hijack implements http.Hijacker if the underlying writer does.
+func (w *sizeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijackWriter(w.ResponseWriter)
+}
+
+// Push implements http.Pusher if the underlying writer does.
+func (w *sizeWriter) Push(target string, opts *http.PushOptions) error {
+	return pushWriter(w.ResponseWriter, target, opts)
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (w *sizeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// bodyCounter wraps a request body to count the bytes read.
+type bodyCounter struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *bodyCounter) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// bodyTimer wraps a request body to stamp the time it was fully read.
+type bodyTimer struct {
+	io.ReadCloser
+	now  func() time.Time
+	done time.Time
+}
+
+func (b *bodyTimer) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && b.done.IsZero() {
+		b.done = b.now()
+	}
+	return n, err
 }
 
 // ServeHTTP implements the http.Handler interface.
 func (e *ExpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !e.didInit {
-		e.init()
+	if !e.Enabled() {
+		e.HandlerFunc(w, r)
+		return
 	}
+	e.initOnce.Do(e.init)
+	arrival := e.now()
 
-	e.Stats.Add("requests", 1)
-	for _, rc := range e.reqCounters {
-		rc.Add(1)
+	var host, tenant, verb, path string
+	if e.PerMethod {
+		verb = methodLabel(r.Method)
+	}
+	if e.pathLabels != nil {
+		path = e.pathLabels.get(sanitizeLabel(e.PathLabel(r), e.separator()))
+	}
+	if e.HostStats {
+		host = e.hostLabel(r)
+	}
+	if e.tenants != nil {
+		tenant = sanitizeLabel(e.TenantFunc(r), e.separator())
+		e.tenants.touch(tenant)
+	}
+	if e.async == nil {
+		e.countRequest(host, tenant, verb, arrival)
+	}
+	if e.headerBytes != nil {
+		e.recordHeaders(r)
+	}
+	if e.bodyPresence {
+		if hasBody(r) {
+			e.Stats.Add(e.key("requests", "with_body"), 1)
+		} else {
+			e.Stats.Add(e.key("requests", "empty"), 1)
+		}
+	}
+	if e.uaFamilies != nil {
+		family := e.uaFamilies.get(sanitizeLabel(e.UAClassifier(r.UserAgent()), e.separator()))
+		e.Stats.Add(e.key("ua", family, "requests"), 1)
+	}
+
+	if e.h2Stats && r.ProtoMajor == 2 {
+		e.Stats.Add(e.key("h2", "requests"), 1)
+		atomic.AddInt64(&e.h2Active, 1)
+		defer atomic.AddInt64(&e.h2Active, -1)
+		w = &h2Writer{ResponseWriter: w, e: e}
+	}
+
+	// deferred before the panic recovery below, so it runs even on a panic
+	n := atomic.AddInt64(&e.inFlight, 1)
+	if e.inFlightDist != nil {
+		e.inFlightDist.Add(n)
+	}
+	defer func() {
+		n := atomic.AddInt64(&e.inFlight, -1)
+		if e.inFlightDist != nil {
+			e.inFlightDist.Add(n)
+		}
+	}()
+
+	var sizes *sizeWriter
+	var reqBody *bodyCounter
+	if e.bodySizes {
+		sizes = &sizeWriter{ResponseWriter: w}
+		w = sizes
+		if r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody {
+			reqBody = &bodyCounter{ReadCloser: r.Body}
+			r.Body = reqBody
+		}
+	}
+	setSizes := func(s *requestStats) {
+		if sizes == nil {
+			return
+		}
+		s.sized, s.respBytes = true, sizes.n
+		if reqBody != nil {
+			s.reqBytes = reqBody.n
+		} else if r.ContentLength > 0 {
+			s.reqBytes = r.ContentLength
+		}
+	}
+
+	var body *bodyTimer
+	if e.RecordProcessTime && r.Body != nil {
+		body = &bodyTimer{ReadCloser: r.Body, now: e.now}
+		r.Body = body
 	}
 
-	startTime := time.Now()
+	startTime := e.now()
 	defer func() {
 		if p := recover(); p != nil {
-			elap := time.Now().Sub(startTime).Nanoseconds()
+			elap := e.now().Sub(startTime).Nanoseconds()
+			stack := debug.Stack()
 
-			if e.Log != nil {
-				e.Log.Println("caught panic: ", p)
+			if l := e.panicLogger(); l != nil {
+				e.panicLog.log(l, e.PanicLogInterval, p, stack)
 			}
-			e.Stats.Add("panics", 1)
-			e.Stats.Add("responses", 1)
-			for _, rc := range e.respCounters {
-				rc.Add(1)
+			if e.panics != nil {
+				e.panics.add(e.now(), p, stack)
 			}
-			e.Stats.Add("responses.500", 1)
-			e.Stats.Add("responses.500.total_ns", elap)
+			stats := requestStats{method: r.Method, url: r.URL, code: http.StatusInternalServerError,
+				elapsed: elap, panicked: true, host: host, tenant: tenant, verb: verb, path: path, arrival: arrival}
+			setSizes(&stats)
+			e.record(stats)
 
+			if e.RePanic {
+				panic(p)
+			}
 			http.Error(w, "server error", http.StatusInternalServerError)
 		}
 	}()
 	////////
 
-	code := e.HandlerFunc(w, r)
+	var code int
+	if e.allocs != nil && atomic.AddInt64(&e.allocSeq, 1)%int64(e.AllocSampleRate) == 0 {
+		code = e.serveCountingAllocs(w, r)
+	} else {
+		code = e.HandlerFunc(w, r)
+	}
 
 	////////
-	elapsed := time.Now().Sub(startTime).Nanoseconds()
-	if e.Log != nil {
-		e.Log.Println(float64(elapsed)/1000000.0, "ms --", code, "--", r.Method, r.URL)
+	endTime := e.now()
+	stats := requestStats{method: r.Method, url: r.URL, code: code,
+		elapsed: endTime.Sub(startTime).Nanoseconds(), host: host, tenant: tenant, verb: verb, path: path,
+		arrival: arrival}
+	if body != nil {
+		stats.timedBody = true
+		stats.process = stats.elapsed
+		if !body.done.IsZero() {
+			stats.process = endTime.Sub(body.done).Nanoseconds()
+		}
+	}
+	setSizes(&stats)
+	e.record(stats)
+}
+
+// addTotalNs adds elapsed to the total_ns counter key, rolling it over by
+// TotalNsRollover when it gets too large.
+func (e *ExpHandler) addTotalNs(key string, elapsed int64) {
+	e.Stats.Add(key, elapsed)
+	if total, ok := e.Stats.Get(key).(*expvar.Int); ok && total.Value() > TotalNsRollover {
+		total.Add(-TotalNsRollover)
+		e.Stats.Add(key+"_rollovers", 1)
+	}
+}
+
+// serveCountingAllocs calls the HandlerFunc and records the (approximate)
+// number of heap allocations made while it ran.
+func (e *ExpHandler) serveCountingAllocs(w http.ResponseWriter, r *http.Request) int {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	code := e.HandlerFunc(w, r)
+	runtime.ReadMemStats(&after)
+	e.allocs.Add(int64(after.Mallocs - before.Mallocs))
+	return code
+}
+
+// record hands off the stats for a completed request, either directly or via
+// the async channel if enabled.
+func (e *ExpHandler) record(s requestStats) {
+	if e.async == nil {
+		e.recordResponse(s)
+		return
+	}
+	if e.AsyncBlock {
+		e.async <- s
+		return
+	}
+	select {
+	case e.async <- s:
+	default:
+		e.Stats.Add(e.key("stats", "dropped"), 1)
+	}
+}
+
+func (e *ExpHandler) runAsync() {
+	for s := range e.async {
+		e.countRequest(s.host, s.tenant, s.verb, s.arrival)
+		e.recordResponse(s)
+	}
+}
+
+// countRequest counts a newly arrived request. at is the arrival time, which
+// in async mode can be well before the aggregator gets to the request.
+func (e *ExpHandler) countRequest(host, tenant, verb string, at time.Time) {
+	e.Stats.Add("requests", 1)
+	for _, rc := range e.reqCounters {
+		rc.Add(1)
+	}
+	if e.recent != nil {
+		e.recent.add(at)
+	}
+	if host != "" {
+		e.Stats.Add(e.key("host", host, "requests"), 1)
+	}
+	if tenant != "" {
+		e.Stats.Add(e.key("tenant", tenant, "requests"), 1)
+	}
+	if verb != "" {
+		e.Stats.Add(e.key("requests", verb), 1)
+	}
+}
+
+func (e *ExpHandler) recordResponse(s requestStats) {
+	code, elapsed := s.code, s.elapsed
+	slow := e.SlowThreshold > 0 && elapsed > e.SlowThreshold.Nanoseconds()
+	if slow {
+		e.Stats.Add(e.key("responses", "slow"), 1)
+	}
+	if s.panicked {
+		e.Stats.Add("panics", 1)
+	} else if e.Log != nil && (slow || e.SlowThreshold == 0) {
+		e.Log.Println(float64(elapsed)/1000000.0, "ms --", code, "--", s.method, s.url)
 	}
 
 	e.Stats.Add("responses", 1)
 	for _, rc := range e.respCounters {
 		rc.Add(1)
 	}
+	if s.host != "" {
+		e.Stats.Add(e.key("host", s.host, "responses"), 1)
+	}
+	if s.tenant != "" {
+		e.Stats.Add(e.key("tenant", s.tenant, "responses"), 1)
+		e.addTotalNs(e.key("tenant", s.tenant, "responses", "total_ns"), elapsed)
+	}
 
-	switch code {
-	case http.StatusOK:
-		e.Stats.Add("responses.200", 1)
-		e.Stats.Add("responses.200.total_ns", elapsed)
-	case http.StatusBadRequest:
-		e.Stats.Add("responses.400", 1)
-		e.Stats.Add("responses.400.total_ns", elapsed)
-	case http.StatusUnauthorized:
-		e.Stats.Add("responses.401", 1)
-		e.Stats.Add("responses.401.total_ns", elapsed)
-	case http.StatusInternalServerError:
-		e.Stats.Add("responses.500", 1)
-		e.Stats.Add("responses.500.total_ns", elapsed)
-	default:
-		e.Stats.Add(fmt.Sprintf("responses.%d", code), 1)
-		e.Stats.Add(fmt.Sprintf("responses.%d.total_ns", code), elapsed)
+	e.slowest.Observe(elapsed, s.method, s.url.Path)
+
+	keys, found := e.codeKeys[code]
+	if !found {
+		c := strconv.Itoa(code)
+		keys = [2]string{e.key("responses", c), e.key("responses", c, "total_ns")}
+	}
+	e.Stats.Add(keys[0], 1)
+	e.addTotalNs(keys[1], elapsed)
+	if class := code / 100; class >= 1 && class < len(e.classKeys) {
+		e.Stats.Add(e.classKeys[class][0], 1)
+		e.addTotalNs(e.classKeys[class][1], elapsed)
+	}
+	if s.verb != "" {
+		c := strconv.Itoa(code)
+		e.Stats.Add(e.key("responses", s.verb, c), 1)
+		e.addTotalNs(e.key("responses", s.verb, c, "total_ns"), elapsed)
+	}
+	if s.path != "" {
+		c := strconv.Itoa(code)
+		e.Stats.Add(e.key("responses", s.path, c), 1)
+		e.addTotalNs(e.key("responses", s.path, c, "total_ns"), elapsed)
+	}
+	if e.latency != nil {
+		for i, b := range e.LatencyBuckets {
+			if elapsed <= b.Nanoseconds() {
+				e.latency[i].Add(1)
+			}
+		}
+		e.latency[len(e.LatencyBuckets)].Add(1)
+	}
+	if e.ResponseHistogram != nil {
+		e.codeHistogram(code).Observe(elapsed)
+	}
+	if e.latencyHdr != nil {
+		e.latencyHdr.Observe(elapsed)
+	}
+	if s.timedBody {
+		e.Stats.Add(e.key("responses", strconv.Itoa(code), "process_ns"), s.process)
+	}
+	if s.sized {
+		e.Stats.Add(e.key("requests", "bytes"), s.reqBytes)
+		e.Stats.Add(e.key("responses", "bytes"), s.respBytes)
 	}
 }
@@ -0,0 +1,31 @@
+package exphttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRecentRequestsAsyncArrival(t *testing.T) {
+	var clock int64 = 1000
+	e := NewExpHandlerFunc("test_recent_async", func(w http.ResponseWriter, r *http.Request) int {
+		atomic.StoreInt64(&clock, 5000)
+		return http.StatusOK
+	}, WithConfig(func(e *ExpHandler) {
+		e.RecentRequests = 4
+		e.AsyncBuffer = 4
+	}))
+	e.nowFunc = func() time.Time { return time.Unix(0, atomic.LoadInt64(&clock)) }
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	want := "[1000]"
+	deadline := time.Now().Add(time.Second)
+	for e.Stats.Get("recent_requests").String() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("recent_requests = %s, want %s", e.Stats.Get("recent_requests"), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,89 @@
+package exphttp
+
+import (
+	"expvar"
+	"strconv"
+	"strings"
+)
+
+// HandlerStats is the change in an ExpHandler's monotonic counters since the
+// previous call to SnapshotAndReset.
+type HandlerStats struct {
+	Requests  int64
+	Responses int64
+	Panics    int64
+
+	// RequestBytes and ResponseBytes are the "requests.bytes" and
+	// "responses.bytes" counters, recorded with RecordBodySizes.
+	RequestBytes  int64
+	ResponseBytes int64
+
+	// Codes and TotalNs are the "responses.<code>" and
+	// "responses.<code>.total_ns" counters, by status code. TotalNsRollovers
+	// counts how many times each total was rolled over by TotalNsRollover
+	// within the interval, so the full total is
+	// TotalNs + TotalNsRollovers*TotalNsRollover.
+	Codes            map[int]int64
+	TotalNs          map[int]int64
+	TotalNsRollovers map[int]int64
+}
+
+// SnapshotAndReset reads the handler's monotonic counters and resets them to
+// zero, so that each call returns the delta since the previous one. Each
+// counter is reduced by exactly the value read, so requests recorded
+// concurrently are counted in the next snapshot rather than lost. Rate
+// counters and other stats are left untouched.
+func (e *ExpHandler) SnapshotAndReset() HandlerStats {
+	s := HandlerStats{
+		Codes:            make(map[int]int64),
+		TotalNs:          make(map[int]int64),
+		TotalNsRollovers: make(map[int]int64),
+	}
+	bytesKeys := [2]string{e.key("requests", "bytes"), e.key("responses", "bytes")}
+	e.Stats.Do(func(kv expvar.KeyValue) {
+		v, ok := kv.Value.(*expvar.Int)
+		if !ok {
+			return
+		}
+		switch kv.Key {
+		case "requests":
+			s.Requests = takeInt(v)
+			return
+		case "responses":
+			s.Responses = takeInt(v)
+			return
+		case "panics":
+			s.Panics = takeInt(v)
+			return
+		case bytesKeys[0]:
+			s.RequestBytes = takeInt(v)
+			return
+		case bytesKeys[1]:
+			s.ResponseBytes = takeInt(v)
+			return
+		}
+
+		parts := strings.Split(kv.Key, e.separator())
+		if len(parts) < 2 || parts[0] != "responses" || !isStatusCode(parts[1]) {
+			return
+		}
+		code, _ := strconv.Atoi(parts[1])
+		switch {
+		case len(parts) == 2:
+			s.Codes[code] = takeInt(v)
+		case len(parts) == 3 && parts[2] == "total_ns":
+			s.TotalNs[code] = takeInt(v)
+		case len(parts) == 3 && parts[2] == "total_ns_rollovers":
+			s.TotalNsRollovers[code] = takeInt(v)
+		}
+	})
+	return s
+}
+
+// takeInt returns the value of v and subtracts it, leaving any concurrent
+// additions in place.
+func takeInt(v *expvar.Int) int64 {
+	n := v.Value()
+	v.Add(-n)
+	return n
+}
@@ -0,0 +1,173 @@
+package exphttp
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
+)
+
+// HdrHistogram is a thread-safe, lock-free High Dynamic Range histogram of
+// non-negative int64 values (e.g. latencies in nanoseconds). It keeps a fixed
+// number of significant decimal digits of precision for every value from 1 up
+// to a maximum, using logarithmically sized buckets, so arbitrary quantiles can
+// be estimated accurately in bounded memory. Observe does not allocate.
+type HdrHistogram struct {
+	max     int64
+	sum     int64
+	highest int64
+	counts  []int64
+
+	subBucketHalfCountMagnitude uint
+	subBucketHalfCount          int64
+	subBucketMask               int64
+}
+
+// NewHdrHistogram makes a new HdrHistogram tracking values up to maxValue
+// with sigFigs (1-5) significant decimal digits. Larger values are recorded as
+// maxValue. Memory use grows with both: 3 digits up to an hour in nanoseconds
+// takes about 300KB.
+func NewHdrHistogram(maxValue int64, sigFigs int) *HdrHistogram {
+	if sigFigs < 1 {
+		sigFigs = 1
+	} else if sigFigs > 5 {
+		sigFigs = 5
+	}
+	if maxValue < 2 {
+		maxValue = 2
+	}
+
+	largestSingleUnit := 2 * int64(math.Pow10(sigFigs))
+	subBucketCountMagnitude := uint(bits.Len64(uint64(largestSingleUnit - 1)))
+	subBucketCount := int64(1) << subBucketCountMagnitude
+
+	bucketCount := 1
+	for smallestUntrackable := subBucketCount; smallestUntrackable <= maxValue; bucketCount++ {
+		if smallestUntrackable > math.MaxInt64/2 {
+			bucketCount++
+			break
+		}
+		smallestUntrackable <<= 1
+	}
+
+	return &HdrHistogram{
+		highest:                     maxValue,
+		counts:                      make([]int64, int64(bucketCount+1)*(subBucketCount/2)),
+		subBucketHalfCountMagnitude: subBucketCountMagnitude - 1,
+		subBucketHalfCount:          subBucketCount / 2,
+		subBucketMask:               subBucketCount - 1,
+	}
+}
+
+// Observe adds a single value into the HdrHistogram. Negative values are
+// recorded as 0.
+func (h *HdrHistogram) Observe(val int64) {
+	if val < 0 {
+		val = 0
+	} else if val > h.highest {
+		val = h.highest
+	}
+	atomic.AddInt64(&h.counts[h.index(val)], 1)
+	atomic.AddInt64(&h.sum, val)
+	for {
+		cur := atomic.LoadInt64(&h.max)
+		if val <= cur || atomic.CompareAndSwapInt64(&h.max, cur, val) {
+			return
+		}
+	}
+}
+
+// index returns the counts index for val.
+func (h *HdrHistogram) index(val int64) int {
+	bucket := int64(bits.Len64(uint64(val|h.subBucketMask))) - int64(h.subBucketHalfCountMagnitude+1)
+	sub := val >> uint(bucket)
+	return int(((bucket + 1) << h.subBucketHalfCountMagnitude) + (sub - h.subBucketHalfCount))
+}
+
+// highestEquivalent returns the largest value that shares a counts index with
+// the values at index i.
+func (h *HdrHistogram) highestEquivalent(i int) int64 {
+	bucket := int64(i>>h.subBucketHalfCountMagnitude) - 1
+	sub := int64(i)&(h.subBucketHalfCount-1) + h.subBucketHalfCount
+	if bucket < 0 {
+		sub -= h.subBucketHalfCount
+		bucket = 0
+	}
+	return (sub+1)<<uint(bucket) - 1
+}
+
+// Snapshot returns a point-in-time copy of the HdrHistogram for querying.
+func (h *HdrHistogram) Snapshot() *HdrSnapshot {
+	s := &HdrSnapshot{
+		Sum:    atomic.LoadInt64(&h.sum),
+		Max:    atomic.LoadInt64(&h.max),
+		h:      h,
+		counts: make([]int64, len(h.counts)),
+	}
+	for i := range h.counts {
+		s.counts[i] = atomic.LoadInt64(&h.counts[i])
+		s.Count += s.counts[i]
+	}
+	return s
+}
+
+// String returns a summary of the HdrHistogram as a JSON object (to implement
+// expvar.Var), e.g.
+//
+//	{"count": 8, "sum": 21000000, "max": 9000000, "p50": 2002943, "p90": 9003007, "p99": 9003007, "p99_9": 9003007}
+func (h *HdrHistogram) String() string {
+	s := h.Snapshot()
+	var buf bytes.Buffer
+	buf.WriteString(`{"count": ` + strconv.FormatInt(s.Count, 10))
+	buf.WriteString(`, "sum": ` + strconv.FormatInt(s.Sum, 10))
+	buf.WriteString(`, "max": ` + strconv.FormatInt(s.Max, 10))
+	for _, q := range hdrSummaryQuantiles {
+		buf.WriteString(`, "` + q.label + `": ` + strconv.FormatInt(s.Quantile(q.q), 10))
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// MarshalJSON implements json.Marshaler.
+func (h *HdrHistogram) MarshalJSON() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+var hdrSummaryQuantiles = []struct {
+	q     float64
+	label string
+}{{0.5, "p50"}, {0.9, "p90"}, {0.99, "p99"}, {0.999, "p99_9"}}
+
+// HdrSnapshot is a point-in-time copy of an HdrHistogram.
+type HdrSnapshot struct {
+	Count int64
+	Sum   int64
+	Max   int64
+
+	h      *HdrHistogram
+	counts []int64
+}
+
+// Quantile returns the value at quantile q (0-1), accurate to the
+// histogram's significant digits, or 0 if there are no observations.
+func (s *HdrSnapshot) Quantile(q float64) int64 {
+	if s.Count == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(q * float64(s.Count)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, n := range s.counts {
+		seen += n
+		if seen >= target {
+			if v := s.h.highestEquivalent(i); v < s.Max {
+				return v
+			}
+			return s.Max
+		}
+	}
+	return s.Max
+}
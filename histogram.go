@@ -0,0 +1,86 @@
+package exphttp
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// Histogram is a thread-safe, lock-free distribution of int64 observations
+// (e.g. response times in nanoseconds or payload sizes in bytes) over a fixed
+// set of bucket boundaries.
+type Histogram struct {
+	sum    int64
+	bounds []int64
+	counts []int64
+}
+
+// NewHistogram makes a new Histogram with the given bucket upper bounds
+// (inclusive). Observations larger than every bound are counted in an
+// overflow bucket.
+func NewHistogram(bounds []int64) *Histogram {
+	b := append([]int64(nil), bounds...)
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return &Histogram{
+		bounds: b,
+		counts: make([]int64, len(b)+1),
+	}
+}
+
+// Observe adds a single value into the Histogram.
+func (h *Histogram) Observe(val int64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return val <= h.bounds[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, val)
+}
+
+// Bounds returns the bucket upper bounds, in ascending order.
+func (h *Histogram) Bounds() []int64 {
+	return append([]int64(nil), h.bounds...)
+}
+
+// Counts returns the number of observations in each bucket (not cumulative),
+// with the overflow bucket last.
+func (h *Histogram) Counts() []int64 {
+	res := make([]int64, len(h.counts))
+	for i := range h.counts {
+		res[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return res
+}
+
+// Sum returns the sum of all observed values.
+func (h *Histogram) Sum() int64 {
+	return atomic.LoadInt64(&h.sum)
+}
+
+// String returns the Histogram as a JSON object (to implement expvar.Var).
+// Buckets are cumulative in the Prometheus style, keyed by upper bound, e.g.
+//
+//	{"le_1000000": 3, "le_5000000": 7, "le_inf": 8, "count": 8, "sum": 21000000}
+func (h *Histogram) String() string {
+	counts := h.Counts()
+	var buf bytes.Buffer
+	var total int64
+	buf.WriteByte('{')
+	for i, n := range counts {
+		total += n
+		if i < len(h.bounds) {
+			buf.WriteString(`"le_` + strconv.FormatInt(h.bounds[i], 10) + `": `)
+		} else {
+			buf.WriteString(`"le_inf": `)
+		}
+		buf.WriteString(strconv.FormatInt(total, 10))
+		buf.WriteString(", ")
+	}
+	buf.WriteString(`"count": ` + strconv.FormatInt(total, 10))
+	buf.WriteString(`, "sum": ` + strconv.FormatInt(h.Sum(), 10))
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// MarshalJSON implements json.Marshaler.
+func (h *Histogram) MarshalJSON() ([]byte, error) {
+	return []byte(h.String()), nil
+}
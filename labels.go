@@ -0,0 +1,96 @@
+package exphttp
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// labelLRU bounds the number of distinct labels (hosts, tenants, etc) that
+// get their own stats, evicting the least recently used label when full so
+// that expvar cardinality can't grow without bound.
+type labelLRU struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+	evict func(label string)
+}
+
+// newLabelLRU creates a labelLRU holding at most max labels. evict is called
+// (with the lock held) for each label removed to make room.
+func newLabelLRU(max int, evict func(label string)) *labelLRU {
+	return &labelLRU{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+		evict: evict,
+	}
+}
+
+// touch marks label as most recently used, adding it if needed.
+func (l *labelLRU) touch(label string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, found := l.items[label]; found {
+		l.ll.MoveToFront(el)
+		return
+	}
+	if l.ll.Len() >= l.max {
+		oldest := l.ll.Back()
+		l.ll.Remove(oldest)
+		old := oldest.Value.(string)
+		delete(l.items, old)
+		if l.evict != nil {
+			l.evict(old)
+		}
+	}
+	l.items[label] = l.ll.PushFront(label)
+}
+
+// sanitizeLabel makes s safe for use as a single part of a stat key, by
+// lowercasing it and replacing dots and the separator with underscores.
+func sanitizeLabel(s, sep string) string {
+	s = strings.ToLower(s)
+	s = strings.ReplaceAll(s, ".", "_")
+	if sep != "" && sep != "." {
+		s = strings.ReplaceAll(s, sep, "_")
+	}
+	if s == "" {
+		return "other"
+	}
+	return s
+}
+
+// labelCap bounds the number of distinct labels that get their own stats by
+// admitting the first max labels seen and collapsing the rest into "other".
+type labelCap struct {
+	mu     sync.RWMutex
+	max    int
+	labels map[string]bool
+}
+
+func newLabelCap(max int) *labelCap {
+	return &labelCap{max: max, labels: make(map[string]bool)}
+}
+
+// get returns label if it is (or can be) admitted, otherwise "other".
+func (c *labelCap) get(label string) string {
+	c.mu.RLock()
+	found := c.labels[label]
+	c.mu.RUnlock()
+	if found {
+		return label
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.labels[label] {
+		return label
+	}
+	if len(c.labels) >= c.max {
+		return "other"
+	}
+	c.labels[label] = true
+	return label
+}
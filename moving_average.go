@@ -1,7 +1,9 @@
 package exphttp
 
 import (
+	"math"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -13,7 +15,14 @@ type MovingAverage struct {
 	otherCounts int64
 	sums        []int64
 	counts      []int64
-	index       int
+	mins        []int64
+	maxs        []int64
+	index       int64
+
+	interval time.Duration
+	lazy     *sync.Once
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 // NewAverage makes a new MovingAverage that never rolls over,
@@ -33,55 +42,195 @@ func NewMovingAverage(interval time.Duration) *MovingAverage {
 // how accurate the moving average is within an interval, at the expense of
 // increased memory usage (two int64 per gran number of "buckets").
 func NewMovingAverageWithGranularity(interval time.Duration, gran int) *MovingAverage {
+	r := newMovingAverage(interval, gran)
+	if len(r.sums) > 1 {
+		go r.rollover()
+	}
+	return r
+}
+
+// NewLazyMovingAverage makes a new MovingAverage like NewMovingAverage, but
+// does not start the background rollover goroutine until the first call to
+// Add.
+func NewLazyMovingAverage(interval time.Duration) *MovingAverage {
+	return NewLazyMovingAverageWithGranularity(interval, DefaultGranularity)
+}
+
+// NewLazyMovingAverageWithGranularity is the lazy equivalent of
+// NewMovingAverageWithGranularity.
+func NewLazyMovingAverageWithGranularity(interval time.Duration, gran int) *MovingAverage {
+	r := newMovingAverage(interval, gran)
+	if len(r.sums) > 1 {
+		r.lazy = &sync.Once{}
+	}
+	return r
+}
+
+func newMovingAverage(interval time.Duration, gran int) *MovingAverage {
 	if interval <= time.Duration(0) || gran <= 1 {
 		return &MovingAverage{
 			sums:   []int64{0},
 			counts: []int64{0},
+			mins:   []int64{math.MaxInt64},
+			maxs:   []int64{math.MinInt64},
 		}
 	}
+	gran = clampGranularity(interval, gran)
 
 	r := &MovingAverage{
-		sums:   make([]int64, gran),
-		counts: make([]int64, gran),
-	}
-
-	go func() {
-		i := 0
-		t := time.NewTicker(interval / time.Duration(gran))
-		for range t.C {
-			i = r.index
-			r.index = (r.index + 1) % gran
-
-			// this is "as atomic" as easily possible...
-			s := atomic.SwapInt64(&r.sums[r.index], 0)
-			n := atomic.SwapInt64(&r.counts[r.index], 0)
-			r.otherSums += r.sums[i] - s
-			r.otherCounts += r.counts[i] - n
+		sums:     make([]int64, gran),
+		counts:   make([]int64, gran),
+		mins:     make([]int64, gran),
+		maxs:     make([]int64, gran),
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	for i := range r.mins {
+		r.mins[i], r.maxs[i] = math.MaxInt64, math.MinInt64
+	}
+	return r
+}
+
+func (r *MovingAverage) rollover() {
+	t := time.NewTicker(r.interval / time.Duration(len(r.sums)))
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
 		}
-	}()
+		r.tick()
+	}
+}
 
-	return r
+// tick expires the oldest bin and moves on to the next. Add and Average may
+// run concurrently, so index and the other totals are only accessed
+// atomically, and re-summed like RateCounter.tick so that an Add that lands
+// in the previous bin just after the move is not lost.
+func (r *MovingAverage) tick() {
+	next := (atomic.LoadInt64(&r.index) + 1) % int64(len(r.sums))
+	atomic.StoreInt64(&r.sums[next], 0)
+	atomic.StoreInt64(&r.counts[next], 0)
+	atomic.StoreInt64(&r.mins[next], math.MaxInt64)
+	atomic.StoreInt64(&r.maxs[next], math.MinInt64)
+	atomic.StoreInt64(&r.index, next)
+
+	var sums, counts int64
+	for i := range r.sums {
+		if int64(i) != next {
+			sums += atomic.LoadInt64(&r.sums[i])
+			counts += atomic.LoadInt64(&r.counts[i])
+		}
+	}
+	atomic.StoreInt64(&r.otherSums, sums)
+	atomic.StoreInt64(&r.otherCounts, counts)
+}
+
+// Stop halts the background rollover goroutine and its ticker. It is safe to
+// call more than once. Add, Average and String remain safe to call
+// afterwards, but the average no longer rolls over, so averages registered
+// with expvar should not be stopped while still published.
+func (r *MovingAverage) Stop() {
+	if r.stop == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		if r.lazy != nil {
+			// never start the goroutine if it hasn't started already
+			r.lazy.Do(func() {})
+		}
+		close(r.stop)
+	})
+}
+
+func (r *MovingAverage) start() {
+	go r.rollover()
 }
 
 // Add an event count into the MovingAverage
 func (r *MovingAverage) Add(val int64) {
-	atomic.AddInt64(&r.sums[r.index], val)
-	atomic.AddInt64(&r.counts[r.index], 1)
+	if r.lazy != nil {
+		r.lazy.Do(r.start)
+	}
+	i := atomic.LoadInt64(&r.index)
+	atomic.AddInt64(&r.sums[i], val)
+	atomic.AddInt64(&r.counts[i], 1)
+	for {
+		cur := atomic.LoadInt64(&r.mins[i])
+		if val >= cur || atomic.CompareAndSwapInt64(&r.mins[i], cur, val) {
+			break
+		}
+	}
+	for {
+		cur := atomic.LoadInt64(&r.maxs[i])
+		if val <= cur || atomic.CompareAndSwapInt64(&r.maxs[i], cur, val) {
+			break
+		}
+	}
 }
 
 // Average returns the average number of events in the last interval
 func (r *MovingAverage) Average() int64 {
-	// this is "as atomic" as easily possible...
-	s := atomic.LoadInt64(&r.sums[r.index])
-	n := atomic.LoadInt64(&r.counts[r.index])
-	s += r.otherSums
-	n += r.otherCounts
+	s, n := r.totals()
+	if n == 0 {
+		return 0
+	}
+	return s / n
+}
+
+// Min returns the smallest value added in the last interval, or 0 if none.
+func (r *MovingAverage) Min() int64 {
+	min := int64(math.MaxInt64)
+	for i := range r.mins {
+		if v := atomic.LoadInt64(&r.mins[i]); v < min {
+			min = v
+		}
+	}
+	if min == math.MaxInt64 {
+		return 0
+	}
+	return min
+}
+
+// Max returns the largest value added in the last interval, or 0 if none.
+func (r *MovingAverage) Max() int64 {
+	max := int64(math.MinInt64)
+	for i := range r.maxs {
+		if v := atomic.LoadInt64(&r.maxs[i]); v > max {
+			max = v
+		}
+	}
+	if max == math.MinInt64 {
+		return 0
+	}
+	return max
+}
+
+// Merge returns the combined average of r and others (sum of sums over sum of
+// counts) without modifying any of them. All should share the same interval
+// and granularity, e.g. per-worker averages of the same metric.
+func (r *MovingAverage) Merge(others ...*MovingAverage) int64 {
+	s, n := r.totals()
+	for _, o := range others {
+		s2, n2 := o.totals()
+		s += s2
+		n += n2
+	}
 	if n == 0 {
 		return 0
 	}
 	return s / n
 }
 
+func (r *MovingAverage) totals() (int64, int64) {
+	// this is "as atomic" as easily possible...
+	i := atomic.LoadInt64(&r.index)
+	s := atomic.LoadInt64(&r.sums[i])
+	n := atomic.LoadInt64(&r.counts[i])
+	return s + atomic.LoadInt64(&r.otherSums), n + atomic.LoadInt64(&r.otherCounts)
+}
+
 // String returns Average() as a string (to implement expvar.Var)
 func (r *MovingAverage) String() string {
 	return strconv.FormatInt(r.Average(), 10)
@@ -0,0 +1,96 @@
+package exphttp
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMovingAverageMinMaxWindow(t *testing.T) {
+	// no rollover goroutine, so the test drives tick itself
+	r := newMovingAverage(time.Hour, 4)
+
+	// first window: values 1000..1003, one per bin
+	for i := int64(0); i < 4; i++ {
+		r.Add(1000 + i)
+		r.tick()
+	}
+	// second window: values 10..13, which expire the whole first window
+	for i := int64(0); i < 4; i++ {
+		r.Add(10 + i)
+		if i < 3 {
+			r.tick()
+		}
+	}
+
+	if got := r.Min(); got != 10 {
+		t.Errorf("Min() = %d, want 10", got)
+	}
+	if got := r.Max(); got != 13 {
+		t.Errorf("Max() = %d, want 13", got)
+	}
+	if got := r.Average(); got != 11 {
+		t.Errorf("Average() = %d, want 11", got)
+	}
+}
+
+// TestMovingAverageConcurrentRollover is meant to be run with -race.
+func TestMovingAverageConcurrentRollover(t *testing.T) {
+	r := NewMovingAverageWithGranularity(20*time.Millisecond, 4)
+	defer r.Stop()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					r.Add(5)
+				}
+			}
+		}()
+	}
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		// sums and counts are read separately, so only check the bounds
+		if avg := r.Average(); avg < 0 || avg > 5 {
+			t.Errorf("Average() = %d, want 0-5", avg)
+		}
+		if min, max := r.Min(), r.Max(); min > 5 || max > 5 {
+			t.Errorf("Min(), Max() = %d, %d, want at most 5", min, max)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestMovingAverageStopGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	averages := make([]*MovingAverage, 100)
+	for i := range averages {
+		averages[i] = NewMovingAverageWithGranularity(time.Minute, 4)
+	}
+	for _, r := range averages {
+		r.Stop()
+		r.Stop()
+		r.Add(1)
+	}
+
+	// give the rollover goroutines a moment to exit
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after Stop, want %d", n, before)
+	}
+	if got := averages[0].Average(); got != 1 {
+		t.Errorf("Average() = %d after Stop, want 1", got)
+	}
+}
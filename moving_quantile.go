@@ -0,0 +1,182 @@
+package exphttp
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultQuantileSamples is the default number of values sampled per bin by a
+// MovingQuantile.
+const DefaultQuantileSamples = 64
+
+// MovingQuantile is a thread-safe tracker of percentiles over a rolling
+// interval, the percentile counterpart to MovingAverage. Like MovingAverage,
+// the interval is split into gran bins that expire on each tick, but each bin
+// keeps a fixed-size random sample of the values added to it rather than a
+// sum, so memory is bounded at gran*samples values.
+type MovingQuantile struct {
+	index int64
+	bins  []quantileBin
+
+	interval time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type quantileBin struct {
+	mu      sync.Mutex
+	seen    int64
+	samples []int64
+}
+
+// NewMovingQuantile makes a new MovingQuantile using the interval provided,
+// DefaultGranularity and DefaultQuantileSamples.
+func NewMovingQuantile(interval time.Duration) *MovingQuantile {
+	return NewMovingQuantileWithGranularity(interval, DefaultGranularity, DefaultQuantileSamples)
+}
+
+// NewMovingQuantileWithGranularity makes a new MovingQuantile using the
+// interval, granularity and per-bin sample size provided. More samples give
+// more accurate tail percentiles, at the expense of memory (one int64 per
+// sample per bin) and slower Percentiles calls.
+func NewMovingQuantileWithGranularity(interval time.Duration, gran, samples int) *MovingQuantile {
+	if samples < 1 {
+		samples = DefaultQuantileSamples
+	}
+	if interval <= time.Duration(0) || gran <= 1 {
+		interval, gran = 0, 1
+	} else {
+		gran = clampGranularity(interval, gran)
+	}
+
+	q := &MovingQuantile{
+		bins:     make([]quantileBin, gran),
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	for i := range q.bins {
+		q.bins[i].samples = make([]int64, 0, samples)
+	}
+	if gran > 1 {
+		go q.rollover()
+	}
+	return q
+}
+
+func (q *MovingQuantile) rollover() {
+	t := time.NewTicker(q.interval / time.Duration(len(q.bins)))
+	defer t.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-t.C:
+		}
+
+		next := (atomic.LoadInt64(&q.index) + 1) % int64(len(q.bins))
+		b := &q.bins[next]
+		b.mu.Lock()
+		b.seen = 0
+		b.samples = b.samples[:0]
+		b.mu.Unlock()
+		atomic.StoreInt64(&q.index, next)
+	}
+}
+
+// Stop halts the background rollover goroutine. Add and Percentiles remain
+// safe to call afterwards, but old values no longer expire.
+func (q *MovingQuantile) Stop() {
+	q.stopOnce.Do(func() { close(q.stop) })
+}
+
+// Add a value into the MovingQuantile. Once a bin's sample is full, values
+// replace existing samples with decreasing probability (reservoir sampling), so
+// every value in the bin is equally likely to be kept.
+func (q *MovingQuantile) Add(val int64) {
+	b := &q.bins[atomic.LoadInt64(&q.index)]
+	b.mu.Lock()
+	b.seen++
+	if len(b.samples) < cap(b.samples) {
+		b.samples = append(b.samples, val)
+	} else if j := rand.Int63n(b.seen); j < int64(len(b.samples)) {
+		b.samples[j] = val
+	}
+	b.mu.Unlock()
+}
+
+// Percentiles returns the values at each of the percentiles ps (0-1) over the
+// last interval, interpolating linearly between the nearest samples. Each
+// sample stands for seen/len(samples) of the values added to its bin, so busy
+// bins outweigh quiet ones. All are 0 if no values have been added.
+func (q *MovingQuantile) Percentiles(ps ...float64) []int64 {
+	var all []weightedSample
+	var total float64
+	for i := range q.bins {
+		b := &q.bins[i]
+		b.mu.Lock()
+		if len(b.samples) > 0 {
+			w := float64(b.seen) / float64(len(b.samples))
+			for _, v := range b.samples {
+				all = append(all, weightedSample{v, w})
+			}
+			total += float64(b.seen)
+		}
+		b.mu.Unlock()
+	}
+
+	res := make([]int64, len(ps))
+	if len(all) == 0 {
+		return res
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].val < all[j].val })
+
+	// each sample sits at the midpoint of the weight it covers
+	mids := make([]float64, len(all))
+	var cum float64
+	for i, s := range all {
+		mids[i] = cum + s.weight/2
+		cum += s.weight
+	}
+	for i, p := range ps {
+		rank := math.Max(0, math.Min(1, p)) * total
+		hi := sort.SearchFloat64s(mids, rank)
+		switch {
+		case hi == 0:
+			res[i] = all[0].val
+		case hi == len(all):
+			res[i] = all[len(all)-1].val
+		default:
+			lo := hi - 1
+			frac := (rank - mids[lo]) / (mids[hi] - mids[lo])
+			res[i] = all[lo].val + int64(float64(all[hi].val-all[lo].val)*frac)
+		}
+	}
+	return res
+}
+
+// weightedSample is a sampled value and the number of added values it
+// stands for.
+type weightedSample struct {
+	val    int64
+	weight float64
+}
+
+// String returns the p50, p95 and p99 as a JSON object (to implement
+// expvar.Var), e.g.
+//
+//	{"p50": 1200, "p95": 5300, "p99": 9100}
+func (q *MovingQuantile) String() string {
+	vals := q.Percentiles(0.5, 0.95, 0.99)
+	var buf bytes.Buffer
+	buf.WriteString(`{"p50": ` + strconv.FormatInt(vals[0], 10))
+	buf.WriteString(`, "p95": ` + strconv.FormatInt(vals[1], 10))
+	buf.WriteString(`, "p99": ` + strconv.FormatInt(vals[2], 10))
+	buf.WriteByte('}')
+	return buf.String()
+}
@@ -0,0 +1,46 @@
+package exphttp
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMovingQuantilePercentiles(t *testing.T) {
+	q := NewMovingQuantileWithGranularity(0, 1, 1000)
+	if got := q.Percentiles(0.5); got[0] != 0 {
+		t.Errorf("empty p50 = %d, want 0", got[0])
+	}
+
+	// uniform 1..100000, sampled down to 1000 values
+	for i := int64(1); i <= 100000; i++ {
+		q.Add(i)
+	}
+	checkPercentiles(t, q.Percentiles(0.5, 0.99), []int64{50000, 99000}, 0.15)
+}
+
+func TestMovingQuantileWeightsBins(t *testing.T) {
+	q := NewMovingQuantileWithGranularity(time.Hour, 2, 1000)
+	defer q.Stop()
+
+	// a busy bin of uniform 1..100000, then a quiet bin of 100 slow values
+	for i := int64(1); i <= 100000; i++ {
+		q.Add(i)
+	}
+	atomic.StoreInt64(&q.index, 1)
+	for i := 0; i < 100; i++ {
+		q.Add(10000000)
+	}
+
+	// the quiet bin holds 9% of the samples but 0.1% of the values
+	checkPercentiles(t, q.Percentiles(0.5, 0.99), []int64{50000, 99000}, 0.15)
+}
+
+func checkPercentiles(t *testing.T, got, want []int64, tolerance float64) {
+	t.Helper()
+	for i := range want {
+		if d := float64(got[i]-want[i]) / float64(want[i]); d < -tolerance || d > tolerance {
+			t.Errorf("percentile %d = %d, want %d within %.0f%%", i, got[i], want[i], tolerance*100)
+		}
+	}
+}
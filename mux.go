@@ -0,0 +1,85 @@
+package exphttp
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// InstrumentMux wraps mux so that every registered route gets its own
+// ExpHandler stats without wrapping each handler. The route for a request is
+// the pattern returned by mux.Handler, and the handler name is prefix followed
+// by the pattern sanitized like a label, with anything other than letters,
+// digits, underscores and dashes also replaced by underscores (e.g. prefix
+// "mux_" and "GET /items/{id}" give "mux_get__items__id_"). Requests that match
+// no pattern are counted under prefix+"notfound". If a name is already taken
+// by another expvar, a numeric suffix is added to keep it unique.
+//
+// Handlers are created on first use with the NewExpHandler defaults, and each
+// request is served by the handler mux.Handler returned, so the route is only
+// matched once. Patterns with wildcards are the exception: mux.Handler does
+// not return the wildcard values, so those requests are served by mux itself
+// to keep r.PathValue working.
+func InstrumentMux(prefix string, mux *http.ServeMux) http.Handler {
+	return &muxHandler{
+		prefix:   prefix,
+		mux:      mux,
+		handlers: make(map[string]*ExpHandler),
+	}
+}
+
+type muxHandler struct {
+	prefix   string
+	mux      *http.ServeMux
+	mu       sync.Mutex
+	handlers map[string]*ExpHandler
+}
+
+// muxRouteKey is the context key for the handler mux.Handler returned.
+type muxRouteKey struct{}
+
+func (m *muxHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h, pattern := m.mux.Handler(r)
+	if strings.Contains(pattern, "{") {
+		h = m.mux
+	}
+
+	m.mu.Lock()
+	e, found := m.handlers[pattern]
+	if !found {
+		e = NewExpHandler(m.routeName(pattern), MakeExpHandlerFunc(serveMuxRoute))
+		m.handlers[pattern] = e
+	}
+	m.mu.Unlock()
+
+	e.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), muxRouteKey{}, h)))
+}
+
+// routeName returns an unused expvar name for pattern. It must be called with
+// m.mu held.
+func (m *muxHandler) routeName(pattern string) string {
+	label := "notfound"
+	if pattern != "" {
+		label = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+				return r
+			}
+			return '_'
+		}, sanitizeLabel(pattern, KeySeparator))
+	}
+	name := m.prefix + label
+	for i := 2; expvar.Get(name) != nil; i++ {
+		name = m.prefix + label + "_" + strconv.Itoa(i)
+	}
+	return name
+}
+
+// serveMuxRoute serves r with the handler stored in its context by
+// muxHandler.ServeHTTP.
+func serveMuxRoute(w http.ResponseWriter, r *http.Request) {
+	r.Context().Value(muxRouteKey{}).(http.Handler).ServeHTTP(w, r)
+}
@@ -0,0 +1,62 @@
+package exphttp
+
+import (
+	"log"
+	"time"
+)
+
+// HandlerOption configures an ExpHandler made by NewExpHandlerFunc.
+type HandlerOption func(e *ExpHandler)
+
+// NewExpHandlerFunc creates a new ExpHandler like NewExpHandler, then applies
+// opts and initializes it immediately, so that every option takes effect
+// (unlike setting fields such as Durations after the first request). Fields
+// that aren't covered by an option can still be set with WithConfig.
+func NewExpHandlerFunc(name string, h ExpHandlerFunc, opts ...HandlerOption) *ExpHandler {
+	e := NewExpHandler(name, h)
+	for _, opt := range opts {
+		opt(e)
+	}
+	e.initOnce.Do(e.init)
+	return e
+}
+
+// WithDurations sets the time spans for the rate counters, replacing the
+// default {"min": time.Minute}.
+func WithDurations(durations map[string]time.Duration) HandlerOption {
+	return func(e *ExpHandler) { e.Durations = durations }
+}
+
+// WithLogger sets the logger for requests and panics. Nil disables logging.
+func WithLogger(l *log.Logger) HandlerOption {
+	return func(e *ExpHandler) { e.Log = l }
+}
+
+// WithSlowThreshold only logs requests that take longer than d, and counts
+// them in "responses.slow".
+func WithSlowThreshold(d time.Duration) HandlerOption {
+	return func(e *ExpHandler) { e.SlowThreshold = d }
+}
+
+// WithHistogram enables a latency Histogram per status code with these
+// bucket upper bounds, published as "responses.<code>.histogram" (see
+// ResponseHistogram).
+func WithHistogram(buckets []time.Duration) HandlerOption {
+	bounds := make([]int64, len(buckets))
+	for i, b := range buckets {
+		bounds[i] = b.Nanoseconds()
+	}
+	return func(e *ExpHandler) { e.ResponseHistogram = bounds }
+}
+
+// WithLatencyBuckets enables the cumulative "latency.le_<bound>" counters
+// with these upper bounds, e.g. DefaultLatencyBuckets (see LatencyBuckets).
+func WithLatencyBuckets(buckets []time.Duration) HandlerOption {
+	return func(e *ExpHandler) { e.LatencyBuckets = buckets }
+}
+
+// WithConfig calls f to set any other ExpHandler fields before it is
+// initialized.
+func WithConfig(f func(e *ExpHandler)) HandlerOption {
+	return HandlerOption(f)
+}
@@ -0,0 +1,42 @@
+package exphttp
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewExpHandlerFuncOptions(t *testing.T) {
+	var logs bytes.Buffer
+	e := NewExpHandlerFunc("test_options", func(w http.ResponseWriter, r *http.Request) int {
+		time.Sleep(2 * time.Millisecond)
+		return http.StatusOK
+	},
+		WithDurations(map[string]time.Duration{"sec": time.Second}),
+		WithLogger(log.New(&logs, "", 0)),
+		WithSlowThreshold(time.Millisecond),
+		WithHistogram([]time.Duration{time.Millisecond, time.Second}),
+		WithLatencyBuckets([]time.Duration{time.Second}),
+		WithConfig(func(e *ExpHandler) { e.PerMethod = true }),
+	)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	for _, key := range []string{"requests_per_sec", "responses.slow", "responses.200.histogram", "latency.le_1000ms", "requests.GET"} {
+		if e.Stats.Get(key) == nil {
+			t.Errorf("stat %q missing", key)
+		}
+	}
+	if e.Stats.Get("requests_per_min") != nil {
+		t.Error("default duration still present with WithDurations")
+	}
+	if got := e.Stats.Get("responses.200.histogram").String(); !strings.Contains(got, `"le_1000000": 0`) {
+		t.Errorf("histogram = %s, want an empty 1ms bucket", got)
+	}
+	if !strings.Contains(logs.String(), "-- 200 --") {
+		t.Errorf("slow request not logged to WithLogger, got %q", logs.String())
+	}
+}
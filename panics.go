@@ -0,0 +1,65 @@
+package exphttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxPanicStack is the most bytes of each stack trace kept by a panicRing.
+const maxPanicStack = 8 << 10
+
+type panicRecord struct {
+	Time  int64  `json:"time"`
+	Panic string `json:"panic"`
+	Stack string `json:"stack"`
+}
+
+// panicRing is a bounded, thread-safe ring of recent panics. Its String
+// method (to implement expvar.Var) renders a JSON array of objects with the
+// unix nanosecond time, panic value and stack trace of each, oldest first.
+type panicRing struct {
+	mu      sync.Mutex
+	entries []panicRecord
+	next    int
+	full    bool
+}
+
+func newPanicRing(size int) *panicRing {
+	return &panicRing{entries: make([]panicRecord, size)}
+}
+
+// add records a panic, overwriting the oldest when full. Stacks are
+// truncated to maxPanicStack bytes.
+func (r *panicRing) add(t time.Time, v interface{}, stack []byte) {
+	if len(stack) > maxPanicStack {
+		stack = stack[:maxPanicStack]
+	}
+	rec := panicRecord{Time: t.UnixNano(), Panic: fmt.Sprint(v), Stack: string(stack)}
+
+	r.mu.Lock()
+	r.entries[r.next] = rec
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+func (r *panicRing) String() string {
+	r.mu.Lock()
+	var res []panicRecord
+	if r.full {
+		res = append(res, r.entries[r.next:]...)
+	}
+	res = append(res, r.entries[:r.next]...)
+	r.mu.Unlock()
+
+	if res == nil {
+		return "[]"
+	}
+	b, _ := json.Marshal(res)
+	return string(b)
+}
@@ -1,14 +1,68 @@
 package exphttp
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/bits"
 	"net/http"
 	"runtime"
 	"strings"
 	"time"
 )
 
+var (
+	// ErrFetch is wrapped by errors returned from Fetch when the HTTP request
+	// itself fails (connection refused, timeout, etc). These are usually
+	// transient and safe to retry.
+	ErrFetch = errors.New("exphttp: fetch failed")
+
+	// ErrDecode is wrapped by errors returned from Fetch when the response
+	// body could not be decoded as expvar JSON.
+	ErrDecode = errors.New("exphttp: decode failed")
+
+	// ErrStatus is matched by a *StatusError returned from Fetch when the
+	// endpoint responds with a non-200 status code.
+	ErrStatus = errors.New("exphttp: unexpected status")
+)
+
+// StatusError is returned by Fetch when the expvar endpoint responds with a
+// non-200 HTTP status code.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "exphttp: unexpected status: " + e.Status
+}
+
+// Is reports whether target is ErrStatus, so callers can use errors.Is.
+func (e *StatusError) Is(target error) bool {
+	return target == ErrStatus
+}
+
+// ContentError is returned by Fetch when the response body isn't a JSON
+// object, e.g. an HTML error page from a proxy in front of the endpoint.
+type ContentError struct {
+	ContentType string
+
+	// Snippet is the start of the response body, for diagnosis.
+	Snippet string
+}
+
+func (e *ContentError) Error() string {
+	return fmt.Sprintf("exphttp: response is not JSON (Content-Type %q): %q", e.ContentType, e.Snippet)
+}
+
+// Is reports whether target is ErrDecode, so callers can use errors.Is.
+func (e *ContentError) Is(target error) bool {
+	return target == ErrDecode
+}
+
 type ExpPoller struct {
 	PluginName string // plugin
 	BaseURL    string
@@ -16,27 +70,271 @@ type ExpPoller struct {
 	Vars       map[string]json.RawMessage
 
 	RecordFunc func(key string, val interface{})
+
+	// BatchRecordFunc, if non-nil, is used instead of RecordFunc and receives
+	// all of a poll cycle's metrics at once, keyed by plugin name and key
+	// (e.g. "memstats.alloc"), so emitters can send a single payload per
+	// cycle. Run calls it after each cycle; when polling manually, call
+	// FlushBatch after the stat methods.
+	BatchRecordFunc func(ts time.Time, metrics map[string]interface{})
+
+	// Client is used for fetch requests if non-nil, e.g. to set a timeout so
+	// a hung server can't stall polling, or to configure TLS. Defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	// Headers are added to each fetch request, e.g. API keys or tenant IDs
+	// required by a gateway in front of the expvar endpoint.
+	Headers http.Header
+
+	// Username and Password, if Username is non-empty, are sent as HTTP
+	// Basic Auth credentials with each fetch request.
+	Username string
+	Password string
+
+	// Separator is the key separator used by the polled process, and for the
+	// keys passed to RecordFunc. Defaults to KeySeparator if empty.
+	Separator string
+
+	// Deltas passes counter-like keys (requests, responses, totals) to
+	// RecordFunc as the change since the previous poll instead of the
+	// cumulative value. Rates and gauges are unaffected. Counters report 0 on
+	// the first poll, and their full value when they first appear later or
+	// decrease (i.e. the polled process restarted). WriteTo is not affected.
+	Deltas bool
+
+	// ChangedOnly only calls RecordFunc for keys whose value changed since
+	// the previous poll. The first poll emits everything. WriteTo is not
+	// affected.
+	ChangedOnly bool
+
+	// FullEvery, if non-zero with ChangedOnly, re-emits every key on every
+	// FullEvery'th poll to guard against lost updates downstream.
+	FullEvery int
+
+	// Quantiles, if non-empty, estimates these quantiles (0-1) from any
+	// cumulative "le_" buckets in the HTTP and RPC stats, such as
+	// ExpHandler.LatencyBuckets or a Histogram, recording e.g. "latency.p99"
+	// for 0.99. Values are interpolated linearly within the containing
+	// bucket, and duration bounds are in nanoseconds.
+	Quantiles []float64
+
+	// DropBuckets skips the raw "le_" bucket values when Quantiles are
+	// recorded.
+	DropBuckets bool
+
+	// Skip lists top-level vars for WalkAll to ignore. If nil, WalkAll skips
+	// the vars handled by the other stat methods.
+	Skip []string
+
+	// FetchRetries is the number of times Run retries a fetch that failed
+	// with a network error (ErrFetch) before waiting for the next interval.
+	FetchRetries int
+
+	// Help optionally maps Prometheus metric family names to HELP text for
+	// WriteTo.
+	Help map[string]string
+
+	meta     metadataRegistry
+	polls    int
+	fullPoll bool
+	unfilter bool
+	last     map[string]interface{}
+	prev     map[string]float64
+	batch    map[string]interface{}
 }
 
+// Fetch retrieves and decodes the expvar JSON from BaseURL. Errors wrap
+// ErrFetch, ErrDecode, or are a *StatusError or *ContentError, so callers can
+// use errors.Is to decide whether a retry is worthwhile.
 func (x *ExpPoller) Fetch() error {
-	if x.RecordFunc == nil {
+	return x.FetchContext(context.Background())
+}
+
+// FetchContext is like Fetch, but the request is aborted if ctx is cancelled
+// or its deadline passes, in which case the error also matches ctx.Err().
+func (x *ExpPoller) FetchContext(ctx context.Context) error {
+	if x.RecordFunc == nil && x.BatchRecordFunc == nil {
 		x.RecordFunc = func(k string, v interface{}) {
 			DefaultRecordFunc(x, k, v)
 		}
 	}
-	resp, err := http.Get(x.BaseURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", x.BaseURL, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFetch, err)
+	}
+	for k, vals := range x.Headers {
+		for _, v := range vals {
+			req.Header.Add(k, v)
+		}
+	}
+	if x.Username != "" {
+		req.SetBasicAuth(x.Username, x.Password)
+	}
+
+	client := x.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFetch, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	body := bufio.NewReader(resp.Body)
+	if err = checkJSON(body, resp.Header.Get("Content-Type")); err != nil {
 		return err
 	}
 
 	x.FetchTime = time.Now()
-	return json.NewDecoder(resp.Body).Decode(&x.Vars)
+	x.polls++
+	x.fullPoll = x.polls == 1 || (x.FullEvery > 0 && (x.polls-1)%x.FullEvery == 0)
+	if err = json.NewDecoder(body).Decode(&x.Vars); err != nil {
+		return fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	return nil
+}
+
+// Run polls the expvar endpoint every interval until ctx is cancelled,
+// calling Fetch and then MemStats, HTTPStats, RPCStats, PoolStats and
+// BuildInfo after each successful fetch. Network errors are retried up to
+// FetchRetries times, a second apart. Fetch errors are logged to
+// DefaultLogger if it is non-nil.
+func (x *ExpPoller) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if x.fetchRetrying(ctx) == nil {
+			x.MemStats()
+			x.HTTPStats()
+			x.RPCStats()
+			x.PoolStats()
+			x.BuildInfo()
+			x.FlushBatch()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// fetchRetrying polls once, retrying only on network errors. Decode and
+// status errors are unlikely to resolve themselves, so they wait for the next
+// interval.
+func (x *ExpPoller) fetchRetrying(ctx context.Context) error {
+	var err error
+	for i := 0; i <= x.FetchRetries; i++ {
+		err = x.FetchContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrFetch) {
+			if DefaultLogger != nil {
+				DefaultLogger.Println("exphttp: bad response:", err)
+			}
+			return err
+		}
+		if DefaultLogger != nil {
+			DefaultLogger.Println("exphttp: network error:", err)
+		}
+		if i == x.FetchRetries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return err
+}
+
+// checkJSON peeks at the start of body and returns a *ContentError unless it
+// looks like a JSON object.
+func checkJSON(body *bufio.Reader, contentType string) error {
+	start, _ := body.Peek(256)
+	trimmed := bytes.TrimLeft(start, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return nil
+	}
+	return &ContentError{ContentType: contentType, Snippet: string(start)}
+}
+
+// record passes a value to RecordFunc, applying the Deltas and ChangedOnly
+// filters.
+func (x *ExpPoller) record(key string, val interface{}) {
+	if x.Deltas && !x.unfilter && isCounterKey(key, x.sep()) {
+		if cur, ok := toFloat(val); ok {
+			val = x.delta(key, cur)
+		}
+	}
+	if x.ChangedOnly && !x.unfilter {
+		if x.last == nil {
+			x.last = make(map[string]interface{})
+		}
+		k := x.PluginName + "\x00" + key
+		if old, found := x.last[k]; found && !x.fullPoll && old == val {
+			return
+		}
+		x.last[k] = val
+	}
+	if x.BatchRecordFunc != nil && !x.unfilter {
+		if x.batch == nil {
+			x.batch = make(map[string]interface{})
+		}
+		x.batch[x.PluginName+x.sep()+key] = val
+		return
+	}
+	x.RecordFunc(key, val)
+}
+
+// delta returns the change in a counter since the previous poll, and
+// remembers cur for the next one.
+func (x *ExpPoller) delta(key string, cur float64) float64 {
+	if x.prev == nil {
+		x.prev = make(map[string]float64)
+	}
+	k := x.PluginName + "\x00" + key
+	prev, found := x.prev[k]
+	x.prev[k] = cur
+	switch {
+	case !found && x.polls <= 1:
+		// no baseline yet
+		return 0
+	case !found, cur < prev:
+		// a new key started from zero, or the process restarted
+		return cur
+	}
+	return cur - prev
+}
+
+// FlushBatch passes the metrics recorded since the last flush to
+// BatchRecordFunc, if any were recorded.
+func (x *ExpPoller) FlushBatch() {
+	if x.BatchRecordFunc == nil || len(x.batch) == 0 {
+		return
+	}
+	batch := x.batch
+	x.batch = nil
+	x.BatchRecordFunc(x.FetchTime, batch)
 }
 
 func DefaultRecordFunc(x *ExpPoller, key string, value interface{}) {
 	fmt.Println(x.FetchTime, x.PluginName, key, value)
 }
 
+// MemStats records the runtime memory stats from the "memstats" var. The
+// "gc.avg_pause_ns" and "gc.max_pause_ns" values cover only the most recent
+// GC pauses, starting from PauseNs[(NumGC+255)%256]; before the 256th GC only
+// the NumGC slots actually written are read.
 func (x *ExpPoller) MemStats() error {
 	var r runtime.MemStats
 
@@ -46,48 +344,64 @@ func (x *ExpPoller) MemStats() error {
 	}
 
 	x.PluginName = "memstats"
-	x.RecordFunc("alloc", r.Alloc)
-	x.RecordFunc("total", r.TotalAlloc)
-	x.RecordFunc("sys", r.Sys)
-	x.RecordFunc("lookups", r.Lookups)
-	x.RecordFunc("mallocs", r.Mallocs)
-	x.RecordFunc("frees", r.Frees)
-
-	x.RecordFunc("heap.alloc", r.HeapAlloc)
-	x.RecordFunc("heap.sys", r.HeapSys)
-	x.RecordFunc("heap.idle", r.HeapIdle)
-	x.RecordFunc("heap.inuse", r.HeapInuse)
-	x.RecordFunc("heap.released", r.HeapReleased)
-	x.RecordFunc("heap.objects", r.HeapObjects)
-
-	x.RecordFunc("stack.inuse", r.StackInuse)
-	x.RecordFunc("stack.sys", r.StackSys)
-	x.RecordFunc("mspan.inuse", r.MSpanInuse)
-	x.RecordFunc("mspan.sys", r.MSpanSys)
-	x.RecordFunc("mcache.inuse", r.MCacheInuse)
-	x.RecordFunc("mcache.sys", r.MCacheSys)
-
-	x.RecordFunc("gc.count", r.NumGC)
-	x.RecordFunc("gc.total_pause_ns", r.PauseTotalNs)
-
-	// calculate average of last 256 GC pauses
-	n := uint64(r.NumGC)
-	if n > 256 {
-		n = 256
-	}
-	var avg, max uint64
-	for i := uint64(0); i < n; i++ {
-		avg += r.PauseNs[i] / n
-		if r.PauseNs[i] > max {
-			max = r.PauseNs[i]
-		}
-	}
-	x.RecordFunc("gc.avg_pause_ns", avg)
-	x.RecordFunc("gc.max_pause_ns", max)
+	x.record("alloc", r.Alloc)
+	x.record("total", r.TotalAlloc)
+	x.record("sys", r.Sys)
+	x.record("lookups", r.Lookups)
+	x.record("mallocs", r.Mallocs)
+	x.record("frees", r.Frees)
+
+	x.record(x.key("heap", "alloc"), r.HeapAlloc)
+	x.record(x.key("heap", "sys"), r.HeapSys)
+	x.record(x.key("heap", "idle"), r.HeapIdle)
+	x.record(x.key("heap", "inuse"), r.HeapInuse)
+	x.record(x.key("heap", "released"), r.HeapReleased)
+	x.record(x.key("heap", "objects"), r.HeapObjects)
+
+	x.record(x.key("stack", "inuse"), r.StackInuse)
+	x.record(x.key("stack", "sys"), r.StackSys)
+	x.record(x.key("mspan", "inuse"), r.MSpanInuse)
+	x.record(x.key("mspan", "sys"), r.MSpanSys)
+	x.record(x.key("mcache", "inuse"), r.MCacheInuse)
+	x.record(x.key("mcache", "sys"), r.MCacheSys)
+
+	x.record(x.key("gc", "count"), r.NumGC)
+	x.record(x.key("gc", "total_pause_ns"), r.PauseTotalNs)
+
+	avg, max := gcPauses(&r)
+	x.record(x.key("gc", "avg_pause_ns"), avg)
+	x.record(x.key("gc", "max_pause_ns"), max)
 
 	return nil
 }
 
+// gcPauses returns the average and maximum of the most recent (up to 256) GC
+// pauses. PauseNs is a circular buffer indexed by NumGC%256, so the window is
+// walked backwards from the latest pause. The sum is kept in 128 bits and
+// divided once, so neither overflow nor per-element rounding skews the
+// average.
+func gcPauses(r *runtime.MemStats) (avg, max uint64) {
+	n := r.NumGC
+	if n > uint32(len(r.PauseNs)) {
+		n = uint32(len(r.PauseNs))
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	var hi, lo uint64
+	for i := uint32(0); i < n; i++ {
+		p := r.PauseNs[(r.NumGC-1-i)%uint32(len(r.PauseNs))]
+		var carry uint64
+		lo, carry = bits.Add64(lo, p, 0)
+		hi += carry
+		if p > max {
+			max = p
+		}
+	}
+	avg, _ = bits.Div64(hi, lo, uint64(n))
+	return avg, max
+}
+
 func (x *ExpPoller) HTTPStats() error {
 	if _, f := x.Vars["exphttp"]; !f {
 		return nil
@@ -99,51 +413,221 @@ func (x *ExpPoller) HTTPStats() error {
 		return err
 	}
 	x.PluginName = "http"
+	sep := x.sep()
+	var errs []error
 	for endpoint := range h {
-		var r map[string]float64
-
-		err = json.Unmarshal(x.Vars[endpoint], &r)
+		r, err := x.endpointStats("exphttp", endpoint)
 		if err != nil {
-			return err
+			// skip it, but keep polling the other endpoints
+			errs = append(errs, err)
+			continue
 		}
 
+		var clientErrs, serverErrs float64
 		for key, val := range r {
-			x.RecordFunc(endpoint+"."+key, val)
-			if strings.HasSuffix(key, ".total_ns") {
-				k2 := strings.TrimSuffix(key, ".total_ns")
-				x.RecordFunc(endpoint+"."+k2+".avg_ns", val/r[k2])
+			if !x.dropKey(key) {
+				x.record(x.key(endpoint, key), val)
+			}
+			if strings.HasSuffix(key, sep+"total_ns") {
+				k2 := strings.TrimSuffix(key, sep+"total_ns")
+				total := val + r[key+"_rollovers"]*TotalNsRollover
+				x.record(x.key(endpoint, k2, "avg_ns"), ratio(total, r[k2]))
+			}
+			if c, ok := strings.CutPrefix(key, "responses"+sep); ok && isStatusCode(c) {
+				switch c[0] {
+				case '4':
+					clientErrs += val
+				case '5':
+					serverErrs += val
+				}
 			}
 		}
 
-		x.RecordFunc(endpoint+".queue_depth", r["requests"]-r["responses"])
-		x.RecordFunc(endpoint+".success_rate", r["responses.200"]*100.0/r["requests"])
-		x.RecordFunc(endpoint+".error_rate", (r["responses"]-r["responses.200"])*100.0/r["requests"])
+		x.recordQuantiles(endpoint+sep, r)
+		x.record(x.key(endpoint, "queue_depth"), r["requests"]-r["responses"])
+		x.record(x.key(endpoint, "success_rate"), percent(r[x.key("responses", "200")], r["requests"]))
+		x.record(x.key(endpoint, "error_rate"), percent(r["responses"]-r[x.key("responses", "200")], r["requests"]))
+		x.record(x.key(endpoint, "client_error_rate"), percent(clientErrs, r["requests"]))
+		x.record(x.key(endpoint, "server_error_rate"), percent(serverErrs, r["requests"]))
 	}
-	return nil
+	return errors.Join(errs...)
+}
+
+// endpointStats decodes the stats var for an endpoint listed in the registry
+// map named by registry, with a clear error if it is missing or malformed.
+func (x *ExpPoller) endpointStats(registry, endpoint string) (map[string]float64, error) {
+	raw, found := x.Vars[endpoint]
+	if !found {
+		return nil, fmt.Errorf("exphttp: %q listed in %s has no stats var", endpoint, registry)
+	}
+	r, err := decodeStats(raw, x.sep())
+	if err != nil {
+		return nil, fmt.Errorf("exphttp: malformed stats var for %q listed in %s: %w", endpoint, registry, err)
+	}
+	return r, nil
 }
 
 func (x *ExpPoller) RPCStats() error {
-	if _, f := x.Vars["exprpc"]; !f {
-		return nil
+	x.PluginName = "rpc"
+	if raw, f := x.Vars["exprpc"]; f {
+		r, err := decodeStats(raw, x.sep())
+		if err != nil {
+			return err
+		}
+		x.rpcStats("", r)
 	}
 
-	var r map[string]float64
-	err := json.Unmarshal(x.Vars["exprpc"], &r)
+	// named servers from NewNamedRPCServer
+	if _, f := x.Vars["exprpcs"]; !f {
+		return nil
+	}
+	var names map[string]int
+	err := json.Unmarshal(x.Vars["exprpcs"], &names)
 	if err != nil {
 		return err
 	}
+	var errs []error
+	for name := range names {
+		r, err := x.endpointStats("exprpcs", name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		x.rpcStats(name+x.sep(), r)
+	}
+	return errors.Join(errs...)
+}
+
+func (x *ExpPoller) rpcStats(prefix string, r map[string]float64) {
+	sep := x.sep()
 
-	x.PluginName = "rpc"
 	for key, val := range r {
-		x.RecordFunc(key, val)
-		if strings.HasSuffix(key, ".total_ns") {
-			k2 := strings.TrimSuffix(key, ".total_ns")
-			x.RecordFunc(k2+".avg_ns", val/r[k2])
+		if !x.dropKey(key) {
+			x.record(prefix+key, val)
+		}
+		if strings.HasSuffix(key, sep+"total_ns") {
+			k2 := strings.TrimSuffix(key, sep+"total_ns")
+			x.record(prefix+x.key(k2, "avg_ns"), ratio(val, r[k2]))
 		}
 	}
 
-	x.RecordFunc("queue_depth", r["requests"]-r["responses"])
-	x.RecordFunc("error_rate", r["responses.error"]*100.0/r["requests"])
-	x.RecordFunc("success_rate", (r["responses"]-r["responses.error"])*100.0/r["requests"])
+	x.recordQuantiles(prefix, r)
+	x.record(prefix+"queue_depth", r["requests"]-r["responses"])
+	x.record(prefix+"error_rate", percent(r[x.key("responses", "error")], r["requests"]))
+	x.record(prefix+"success_rate", percent(r["responses"]-r[x.key("responses", "error")], r["requests"]))
+}
+
+// PoolStats records worker-pool stats published by the application under the
+// conventional top-level "pools" map, of the form:
+//
+//	{"pools": {"<name>": {"active": 3, "idle": 5, "queued": 0}}}
+//
+// as "pool.<name>.active", "pool.<name>.idle" and "pool.<name>.queued", plus
+// "pool.<name>.utilization", the percentage of workers that are active.
+func (x *ExpPoller) PoolStats() error {
+	if _, f := x.Vars["pools"]; !f {
+		return nil
+	}
+
+	var pools map[string]struct {
+		Active float64 `json:"active"`
+		Idle   float64 `json:"idle"`
+		Queued float64 `json:"queued"`
+	}
+	err := json.Unmarshal(x.Vars["pools"], &pools)
+	if err != nil {
+		return fmt.Errorf("exphttp: malformed pools var: %w", err)
+	}
+
+	x.PluginName = "pools"
+	for name, p := range pools {
+		name = sanitizeLabel(name, x.sep())
+		x.record(x.key("pool", name, "active"), p.Active)
+		x.record(x.key("pool", name, "idle"), p.Idle)
+		x.record(x.key("pool", name, "queued"), p.Queued)
+		x.record(x.key("pool", name, "utilization"), percent(p.Active, p.Active+p.Idle))
+	}
 	return nil
 }
+
+// IsCounter guesses whether key is a monotonic counter (e.g. "requests" or
+// "responses.200.total_ns") rather than a gauge, from the naming conventions
+// used by ExpHandler, ExpRPCServer and MemStats.
+func (x *ExpPoller) IsCounter(key string) bool {
+	return isCounterKey(key, x.sep())
+}
+
+// IsLatencyBucket returns true for keys of the cumulative latency bucket
+// counters published by ExpHandler.LatencyBuckets, e.g.
+// "thepage.latency.le_5ms". These are monotonic and best graphed as derives.
+func (x *ExpPoller) IsLatencyBucket(key string) bool {
+	sep := x.sep()
+	return strings.Contains(sep+key, sep+"latency"+sep+"le_")
+}
+
+// ratio returns num/den, or 0 if den is 0, so that idle endpoints never
+// produce Inf or NaN values.
+func ratio(num, den float64) float64 {
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// percent returns num as a percentage of den, or 0 if den is 0.
+func percent(num, den float64) float64 {
+	if den == 0 {
+		return 0
+	}
+	return num * 100.0 / den
+}
+
+func (x *ExpPoller) sep() string {
+	if x.Separator != "" {
+		return x.Separator
+	}
+	return KeySeparator
+}
+
+// key joins parts of a key with the poller's separator.
+func (x *ExpPoller) key(parts ...string) string {
+	return strings.Join(parts, x.sep())
+}
+
+// decodeStats decodes an expvar.Map of stats into a flat map of numbers.
+// Nested objects (e.g. a Histogram) are flattened into dotted keys, and
+// non-numeric values are skipped.
+func decodeStats(raw json.RawMessage, sep string) (map[string]float64, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	r := make(map[string]float64, len(m))
+	flattenStats(r, "", sep, m)
+	return r, nil
+}
+
+// marshaledRate returns the rate from a RateCounter encoded by its
+// MarshalJSON method, so it is recorded the same as a bare number.
+func marshaledRate(m map[string]interface{}) (float64, bool) {
+	if _, ok := m["interval_ns"]; !ok || len(m) != 2 {
+		return 0, false
+	}
+	rate, ok := m["rate"].(float64)
+	return rate, ok
+}
+
+func flattenStats(r map[string]float64, prefix, sep string, m map[string]interface{}) {
+	for key, val := range m {
+		switch v := val.(type) {
+		case float64:
+			r[prefix+key] = v
+		case map[string]interface{}:
+			if rate, ok := marshaledRate(v); ok {
+				r[prefix+key] = rate
+				continue
+			}
+			flattenStats(r, prefix+key+sep, sep, v)
+		}
+	}
+}
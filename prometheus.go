@@ -0,0 +1,398 @@
+package exphttp
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sample is a single metric value in a form that maps directly onto
+// Prometheus-style collectors, without depending on a client library.
+type Sample struct {
+	// Name is the metric name, e.g. "exphttp_responses_total". For the series
+	// of a histogram it has the _bucket, _sum or _count suffix.
+	Name string
+
+	// Labels are the label pairs for this sample, e.g. {"code": "200"}.
+	Labels map[string]string
+
+	// Value is the current value of the sample.
+	Value float64
+
+	// Counter is true for monotonic counters, false for gauges.
+	Counter bool
+
+	// Histogram, if non-empty, is the name of the histogram family this
+	// sample is a series of. Its _bucket series are labeled with le.
+	Histogram string
+}
+
+// LabelNames returns the sample's label names in sorted order.
+func (s Sample) LabelNames() []string {
+	names := make([]string, 0, len(s.Labels))
+	for k := range s.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Family returns the metric family the sample belongs to: Histogram if it is
+// set, otherwise Name.
+func (s Sample) Family() string {
+	if s.Histogram != "" {
+		return s.Histogram
+	}
+	return s.Name
+}
+
+// Samples returns the handler's current stats as Prometheus-style samples,
+// labeled with handler=e.Name. Breakdowns of a stat are labels on a shared
+// family, so "responses.200", "responses.2xx" and "responses.GET.200" become
+// exphttp_responses_total{code="200"},
+// exphttp_responses_by_class_total{class="2xx"} and
+// exphttp_responses_by_method_total{code="200",method="GET"}, and their
+// total_ns keys the matching exphttp_response_ns families; see statFamily for
+// the full list. The bare "requests" and "responses" aggregates are
+// exphttp_requests_all_total and exphttp_responses_all_total so they are not
+// summed with the breakdowns. LatencyBuckets and ResponseHistogram are
+// exported as the histograms exphttp_latency_ns and
+// exphttp_response_duration_ns{code="200"}. With LatencyHdrSigFigs, the
+// summary quantiles are exphttp_latency_hdr_ns{quantile="0.99"} gauges.
+func (e *ExpHandler) Samples() []Sample {
+	res := statSamples("exphttp", e.separator(), e.Stats, statFamily)
+	for _, s := range res {
+		s.Labels["handler"] = e.Name
+	}
+	if snap := e.LatencySnapshot(); snap != nil {
+		for _, q := range hdrSummaryQuantiles {
+			res = append(res, Sample{
+				Name:   "exphttp_latency_hdr_ns",
+				Labels: map[string]string{"handler": e.Name, "quantile": strconv.FormatFloat(q.q, 'f', -1, 64)},
+				Value:  float64(snap.Quantile(q.q)),
+			})
+		}
+	}
+	return res
+}
+
+// familyFunc maps a stat key onto its metric family and labels.
+type familyFunc func(sep, key string) (string, map[string]string)
+
+// statSamples converts every stat in m into Samples, using family to name
+// them. The latency buckets
+// have no sum of their own, so the _sum of the latency histogram is the total
+// of the per-code total_ns counters, which time the same responses.
+func statSamples(prefix, sep string, m *expvar.Map, family familyFunc) []Sample {
+	var res []Sample
+	latency := promName(prefix, "latency_ns")
+	var hasLatency bool
+	var latencySum float64
+	m.Do(func(kv expvar.KeyValue) {
+		for _, s := range statSample(prefix, sep, kv, family) {
+			switch s.Name {
+			case latency + "_count":
+				hasLatency = true
+			case promName(prefix, "response_ns_total"):
+				latencySum += s.Value
+			case promName(prefix, "response_ns_rollovers_total"):
+				latencySum += s.Value * TotalNsRollover
+			}
+			res = append(res, s)
+		}
+	})
+	if hasLatency {
+		res = append(res, Sample{Name: latency + "_sum", Labels: make(map[string]string), Value: latencySum, Counter: true, Histogram: latency})
+	}
+	return res
+}
+
+// statSample converts a single expvar stat into Samples: one for a number,
+// the _bucket (and for "le_inf", _count) series of a bucket counter, or all
+// the series of a Histogram. Other values are skipped.
+func statSample(prefix, sep string, kv expvar.KeyValue, family familyFunc) []Sample {
+	name, labels := family(sep, kv.Key)
+	name = promName(prefix, name)
+
+	str := kv.Value.String()
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		var h map[string]float64
+		if json.Unmarshal([]byte(str), &h) != nil {
+			return nil
+		}
+		return histogramSamples(name, labels, h)
+	}
+
+	if le, ok := labels["le"]; ok {
+		res := []Sample{{Name: name + "_bucket", Labels: labels, Value: val, Counter: true, Histogram: name}}
+		if le == "+Inf" {
+			res = append(res, Sample{Name: name + "_count", Labels: withoutLabel(labels, "le"), Value: val, Counter: true, Histogram: name})
+		}
+		return res
+	}
+
+	s := Sample{Name: name, Labels: labels, Value: val, Counter: isCounterKey(kv.Key, sep)}
+	if s.Counter && !strings.HasSuffix(s.Name, "_total") {
+		s.Name += "_total"
+	}
+	return []Sample{s}
+}
+
+// histogramSamples returns the series of a Histogram from its JSON form, or
+// nil if h has no buckets, count and sum.
+func histogramSamples(family string, labels map[string]string, h map[string]float64) []Sample {
+	count, hasCount := h["count"]
+	sum, hasSum := h["sum"]
+	if !hasCount || !hasSum {
+		return nil
+	}
+	var res []Sample
+	for key, val := range h {
+		bound, ok := strings.CutPrefix(key, "le_")
+		if !ok {
+			continue
+		}
+		if b, ok := bucketBound(bound); ok {
+			bl := copyLabels(labels)
+			bl["le"] = leLabel(b)
+			res = append(res, Sample{Name: family + "_bucket", Labels: bl, Value: val, Counter: true, Histogram: family})
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return append(res,
+		Sample{Name: family + "_sum", Labels: copyLabels(labels), Value: sum, Counter: true, Histogram: family},
+		Sample{Name: family + "_count", Labels: copyLabels(labels), Value: count, Counter: true, Histogram: family})
+}
+
+// statFamily maps an ExpHandler stat key onto its metric family (before the prefix and
+// any _total suffix) and labels, so that every breakdown of a stat shares a
+// family:
+//
+//	requests, responses                    requests_all, responses_all
+//	responses.<code>[.total_ns]            responses, response_ns {code}
+//	responses.<code>.process_ns            response_process_ns {code}
+//	responses.<code>.histogram             response_duration_ns {code}
+//	responses.<N>xx[.total_ns]             responses_by_class, response_ns_by_class {class}
+//	requests.<METHOD>                      requests_by_method {method}
+//	responses.<METHOD>.<code>[.total_ns]   responses_by_method, response_ns_by_method {method, code}
+//	responses.<path>.<code>[.total_ns]     responses_by_path, response_ns_by_path {path, code}
+//	host.<host>.requests|responses         host_requests, host_responses {host}
+//	tenant.<id>.requests|responses         tenant_requests, tenant_responses {tenant}
+//	tenant.<id>.responses.total_ns         tenant_response_ns {tenant}
+//	ua.<family>.requests                   ua_requests {ua}
+//	latency.le_<bound>                     latency_ns {le}
+//
+// A total_ns_rollovers key maps like its total_ns key, with _rollovers
+// appended to the family. Any other key is its own family.
+func statFamily(sep, key string) (string, map[string]string) {
+	labels := make(map[string]string)
+	parts := strings.Split(key, sep)
+	n := len(parts)
+	rollovers := parts[n-1] == "total_ns_rollovers"
+	if rollovers {
+		parts[n-1] = "total_ns"
+	}
+
+	var name string
+	switch {
+	case n == 1 && (parts[0] == "requests" || parts[0] == "responses"):
+		name = parts[0] + "_all"
+	case n >= 2 && parts[0] == "responses" && isStatusCode(parts[1]):
+		labels["code"] = parts[1]
+		switch {
+		case n == 3 && parts[2] == "process_ns":
+			name = "response_process_ns"
+		case n == 3 && parts[2] == "histogram":
+			name = "response_duration_ns"
+		default:
+			name = responseFamily(parts[2:], "")
+		}
+	case n >= 2 && parts[0] == "responses" && isStatusClass(parts[1]):
+		labels["class"] = parts[1]
+		name = responseFamily(parts[2:], "_by_class")
+	case n == 2 && parts[0] == "requests" && methodLabel(parts[1]) == parts[1]:
+		labels["method"] = parts[1]
+		name = "requests_by_method"
+	case n >= 3 && parts[0] == "responses" && isStatusCode(parts[2]):
+		labels["code"] = parts[2]
+		if methodLabel(parts[1]) == parts[1] {
+			labels["method"] = parts[1]
+			name = responseFamily(parts[3:], "_by_method")
+		} else {
+			labels["path"] = parts[1]
+			name = responseFamily(parts[3:], "_by_path")
+		}
+	case n == 3 && (parts[0] == "host" || parts[0] == "tenant" || parts[0] == "ua") &&
+		(parts[2] == "requests" || parts[2] == "responses"):
+		labels[parts[0]] = parts[1]
+		name = parts[0] + "_" + parts[2]
+	case n == 4 && parts[0] == "tenant" && parts[2] == "responses" && parts[3] == "total_ns":
+		labels["tenant"] = parts[1]
+		name = "tenant_response_ns"
+	case n == 2 && parts[0] == "latency" && strings.HasPrefix(parts[1], "le_"):
+		if b, ok := bucketBound(parts[1][len("le_"):]); ok {
+			labels["le"] = leLabel(b)
+			name = "latency_ns"
+		}
+	}
+
+	if name == "" {
+		return key, make(map[string]string)
+	}
+	if rollovers {
+		name += "_rollovers"
+	}
+	return name, labels
+}
+
+// rpcFamily maps an ExpRPCServer stat key onto its metric family (before the
+// prefix and any _total suffix) and labels, like statFamily does for
+// ExpHandler. Method names such as "Arith.Multiply" may contain the
+// separator, so keys are matched by their known prefixes and suffixes:
+//
+//	requests, responses                  requests_all, responses_all
+//	requests.<method>                    requests_by_method {method}
+//	requests.<service>                   requests_by_service {service}
+//	requests.by_client.<addr>            requests_by_client {client}
+//	requests.<method>.per_<label>        requests_by_method_per_<label> {method}
+//	responses.<method>                   responses_by_method {method}
+//	responses.<service>                  responses_by_service {service}
+//	responses.<method>.total_ns          response_ns_by_method {method}
+//	responses.<method>.error[.total_ns]  response_errors_by_method, response_error_ns_by_method {method}
+//	responses.<method>.chunks            response_chunks_by_method {method}
+//	responses.<method>.wait_ns|exec_ns   response_wait_ns_by_method, response_exec_ns_by_method {method}
+//	responses.<method>.error_rate_per_<label>  response_error_rate_per_<label> {method}
+//	responses.error.<category>           responses_by_error {category}
+//	methods.<method>.<kind>_size         <kind>_size {method}
+//
+// The server-wide keys, e.g. "responses.total_ns" and "responses.error", are
+// their own families.
+func rpcFamily(sep, key string) (string, map[string]string) {
+	labels := make(map[string]string)
+	var name string
+	if key == "requests" || key == "responses" {
+		return key + "_all", labels
+	}
+
+	if rest, ok := strings.CutPrefix(key, "requests"+sep); ok {
+		if client, ok := strings.CutPrefix(rest, "by_client"+sep); ok {
+			labels["client"] = client
+			name = "requests_by_client"
+		} else if i := strings.LastIndex(rest, sep+"per_"); i > 0 {
+			labels["method"] = rest[:i]
+			name = "requests_by_method_" + rest[i+len(sep):]
+		} else if !strings.HasPrefix(rest, "per_") {
+			name = rpcCallFamily("requests", rest, labels)
+		}
+	} else if rest, ok := strings.CutPrefix(key, "responses"+sep); ok {
+		switch {
+		case rest == "total_ns", rest == "slow", rest == "error", rest == "error"+sep+"total_ns",
+			strings.HasPrefix(rest, "per_"):
+			// server-wide
+		case strings.HasPrefix(rest, "error"+sep):
+			labels["category"] = rest[len("error"+sep):]
+			name = "responses_by_error"
+		default:
+			name = rpcResponseFamily(sep, rest, labels)
+		}
+	} else if rest, ok := strings.CutPrefix(key, "methods"+sep); ok {
+		if i := strings.LastIndex(rest, sep); i > 0 && strings.HasSuffix(rest, "_size") {
+			labels["method"] = rest[:i]
+			name = rest[i+len(sep):]
+		}
+	}
+
+	if name == "" {
+		return key, make(map[string]string)
+	}
+	return name, labels
+}
+
+// rpcResponseFamily returns the family of a per-method or per-service
+// responses key, given the part after "responses", and sets its labels.
+func rpcResponseFamily(sep, rest string, labels map[string]string) string {
+	for _, f := range []struct{ suffix, name string }{
+		{"error" + sep + "total_ns", "response_error_ns_by_method"},
+		{"error", "response_errors_by_method"},
+		{"total_ns", "response_ns_by_method"},
+		{"chunks", "response_chunks_by_method"},
+		{"wait_ns", "response_wait_ns_by_method"},
+		{"exec_ns", "response_exec_ns_by_method"},
+	} {
+		if method, ok := strings.CutSuffix(rest, sep+f.suffix); ok {
+			labels["method"] = method
+			return f.name
+		}
+	}
+	if i := strings.LastIndex(rest, sep+"error_rate_per_"); i > 0 {
+		labels["method"] = rest[:i]
+		return "response_" + rest[i+len(sep):]
+	}
+	return rpcCallFamily("responses", rest, labels)
+}
+
+// rpcCallFamily returns the family of a bare per-method or per-service
+// count, and sets its label. Method names are "Service.Method", so a name
+// without a dot is a service.
+func rpcCallFamily(kind, name string, labels map[string]string) string {
+	if strings.Contains(name, ".") {
+		labels["method"] = name
+		return kind + "_by_method"
+	}
+	labels["service"] = name
+	return kind + "_by_service"
+}
+
+// responseFamily returns the family of a responses counter, or of its
+// total_ns when rest is just "total_ns", with suffix appended. It returns ""
+// for anything else.
+func responseFamily(rest []string, suffix string) string {
+	switch {
+	case len(rest) == 0:
+		return "responses" + suffix
+	case len(rest) == 1 && rest[0] == "total_ns":
+		return "response_ns" + suffix
+	}
+	return ""
+}
+
+// leLabel formats a bucket bound as the value of an le label.
+func leLabel(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'f', -1, 64)
+}
+
+// copyLabels returns a copy of labels, so that samples never share a map.
+func copyLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+// withoutLabel returns a copy of labels without name.
+func withoutLabel(labels map[string]string, name string) map[string]string {
+	res := copyLabels(labels)
+	delete(res, name)
+	return res
+}
+
+func isStatusCode(s string) bool {
+	code, err := strconv.Atoi(s)
+	return err == nil && code >= 100 && code <= 999
+}
+
+// isStatusClass returns true for the status class labels used by ExpHandler,
+// e.g. "2xx".
+func isStatusClass(s string) bool {
+	return len(s) == 3 && s[0] >= '1' && s[0] <= '9' && s[1:] == "xx"
+}
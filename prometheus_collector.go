@@ -0,0 +1,121 @@
+//go:build prometheus
+// +build prometheus
+
+package exphttp
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusCollector adapts one or more ExpHandlers to a
+// prometheus.Collector, so they can be registered directly with a
+// prometheus.Registry instead of scraping expvar. It is only built with the
+// "prometheus" build tag, so the core package does not depend on the client
+// library.
+type PrometheusCollector struct {
+	handlers []*ExpHandler
+}
+
+// NewPrometheusCollector creates a PrometheusCollector for the handlers given.
+func NewPrometheusCollector(handlers ...*ExpHandler) *PrometheusCollector {
+	return &PrometheusCollector{handlers: handlers}
+}
+
+// Describe implements prometheus.Collector. It sends no descriptors, making
+// this an unchecked collector, because the set of status codes seen by a
+// handler is only known at runtime.
+func (c *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector. The series of each histogram in
+// ExpHandler.Samples are gathered into a single const histogram.
+func (c *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, e := range c.handlers {
+		hists := make(map[string]*constHistogram)
+		var order []string
+		for _, s := range e.Samples() {
+			if s.Histogram != "" {
+				h := histogramFor(hists, &order, s)
+				switch s.Name {
+				case s.Histogram + "_bucket":
+					bound, err := strconv.ParseFloat(s.Labels["le"], 64)
+					if err == nil && !math.IsInf(bound, 1) {
+						h.buckets[bound] = uint64(s.Value)
+					}
+				case s.Histogram + "_sum":
+					h.sum = s.Value
+				case s.Histogram + "_count":
+					h.count = uint64(s.Value)
+				}
+				continue
+			}
+
+			names, values := labelPairs(s.Labels)
+			desc := prometheus.NewDesc(s.Name, "exphttp metric "+s.Name, names, nil)
+			typ := prometheus.GaugeValue
+			if s.Counter {
+				typ = prometheus.CounterValue
+			}
+			m, err := prometheus.NewConstMetric(desc, typ, s.Value, values...)
+			if err != nil {
+				m = prometheus.NewInvalidMetric(desc, err)
+			}
+			ch <- m
+		}
+
+		for _, key := range order {
+			h := hists[key]
+			m, err := prometheus.NewConstHistogram(h.desc, h.count, h.sum, h.buckets, h.values...)
+			if err != nil {
+				m = prometheus.NewInvalidMetric(h.desc, err)
+			}
+			ch <- m
+		}
+	}
+}
+
+// constHistogram collects the series of one histogram from Samples.
+type constHistogram struct {
+	desc    *prometheus.Desc
+	values  []string
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+// histogramFor returns the constHistogram that s is a series of, creating it
+// and appending its key to order the first time it is seen.
+func histogramFor(hists map[string]*constHistogram, order *[]string, s Sample) *constHistogram {
+	labels := make(map[string]string, len(s.Labels))
+	for k, v := range s.Labels {
+		if k != "le" {
+			labels[k] = v
+		}
+	}
+	names, values := labelPairs(labels)
+	key := s.Histogram + "\xff" + strings.Join(values, "\xff")
+	if h, ok := hists[key]; ok {
+		return h
+	}
+	h := &constHistogram{
+		desc:    prometheus.NewDesc(s.Histogram, "exphttp metric "+s.Histogram, names, nil),
+		values:  values,
+		buckets: make(map[float64]uint64),
+	}
+	hists[key] = h
+	*order = append(*order, key)
+	return h
+}
+
+// labelPairs returns the sorted label names of labels and their values.
+func labelPairs(labels map[string]string) ([]string, []string) {
+	names := Sample{Labels: labels}.LabelNames()
+	values := make([]string, len(names))
+	for i, n := range names {
+		values[i] = labels[n]
+	}
+	return names, values
+}
@@ -0,0 +1,197 @@
+package exphttp
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrometheusHandler returns an http.Handler that serves the stats of every
+// ExpHandler, ExpRPCServer and the runtime memstats in the Prometheus text
+// exposition format, read directly from their expvar maps. Handler stats are
+// labeled as by ExpHandler.Samples, e.g.
+// exphttp_responses_total{code="200",handler="thepage"}, and RPC stats are
+// labeled with server="exprpc" or the name given to NewNamedRPCServer, with
+// method, service, client and category labels for their breakdowns, e.g.
+// exprpc_responses_by_method_total{method="Arith.Multiply",server="exprpc"}.
+// The conventional "pools" var and the one published by PublishBuildInfo are
+// included when present.
+func PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writePrometheus(w, func(key string) bool { return true })
+	})
+}
+
+// writePrometheus serves the samples of the local vars that include accepts,
+// as both PrometheusHandler and MetricsHandler do.
+func writePrometheus(w http.ResponseWriter, include func(key string) bool) {
+	var samples []Sample
+	for _, e := range AllHandlers() {
+		if include(e.Name) {
+			samples = append(samples, e.Samples()...)
+		}
+	}
+	samples = append(samples, rpcSamples(include)...)
+	if include("memstats") {
+		samples = append(samples, memSamples()...)
+	}
+	if include("pools") {
+		samples = append(samples, poolSamples()...)
+	}
+	if include("buildinfo") {
+		samples = append(samples, buildInfoSamples()...)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := writeSamples(w, samples); err != nil && DefaultLogger != nil {
+		DefaultLogger.Println("exphttp: writing metrics:", err)
+	}
+}
+
+// rpcSamples returns the stats of the shared and named RPC servers that
+// include accepts.
+func rpcSamples(include func(key string) bool) []Sample {
+	var res []Sample
+	add := func(server string, m *expvar.Map) {
+		for _, s := range statSamples("exprpc", KeySeparator, m, rpcFamily) {
+			s.Labels["server"] = server
+			res = append(res, s)
+		}
+	}
+	if rpcStats != nil && include("exprpc") {
+		add("exprpc", rpcStats)
+	}
+	if rpcServers != nil {
+		rpcServers.Do(func(kv expvar.KeyValue) {
+			if m, ok := expvar.Get(kv.Key).(*expvar.Map); ok && include(kv.Key) {
+				add(kv.Key, m)
+			}
+		})
+	}
+	return res
+}
+
+// memSamples returns the runtime memstats, using the same keys as
+// ExpPoller.MemStats.
+func memSamples() []Sample {
+	var res []Sample
+	x := &ExpPoller{Vars: localVars(func(key string) bool { return key == "memstats" })}
+	x.RecordFunc = func(key string, val interface{}) {
+		v, ok := toFloat(val)
+		if !ok {
+			return
+		}
+		s := Sample{Name: promName("memstats", key), Labels: map[string]string{}, Value: v, Counter: isCounterKey(key, x.sep())}
+		if s.Counter && !strings.HasSuffix(s.Name, "_total") {
+			s.Name += "_total"
+		}
+		res = append(res, s)
+	}
+	x.MemStats()
+	return res
+}
+
+// poolSamples returns the conventional "pools" var, using the same keys as
+// ExpPoller.PoolStats but with the pool name as a label, e.g.
+// pools_active{pool="db"}.
+func poolSamples() []Sample {
+	var res []Sample
+	x := &ExpPoller{Vars: localVars(func(key string) bool { return key == "pools" })}
+	x.RecordFunc = func(key string, val interface{}) {
+		v, ok := toFloat(val)
+		parts := strings.Split(key, x.sep())
+		if !ok || len(parts) != 3 {
+			return
+		}
+		res = append(res, Sample{Name: promName("pools", parts[2]), Labels: map[string]string{"pool": parts[1]}, Value: v})
+	}
+	x.PoolStats()
+	return res
+}
+
+// buildInfoSamples returns the var published by PublishBuildInfo as the same
+// exphttp_build_info gauge written by ExpPoller.WriteTo.
+func buildInfoSamples() []Sample {
+	x := &ExpPoller{Vars: localVars(func(key string) bool { return key == "buildinfo" })}
+	b, ok, _ := x.buildInfo()
+	if !ok {
+		return nil
+	}
+	return []Sample{{
+		Name: "exphttp_build_info",
+		Labels: map[string]string{
+			"version":    b.Version,
+			"commit":     b.Commit,
+			"build_time": b.BuildTime.UTC().Format(time.RFC3339),
+		},
+		Value: 1,
+	}}
+}
+
+// writeSamples writes samples in the text exposition format, grouped by
+// metric family so each family's HELP and TYPE lines come first. The series
+// of each histogram are written with their buckets in increasing order of le,
+// followed by _sum and _count.
+func writeSamples(w http.ResponseWriter, samples []Sample) error {
+	type sortKey struct {
+		family, labels string
+		series         int
+		le             float64
+	}
+	keys := make([]sortKey, len(samples))
+	labels := make([]string, len(samples))
+	for i, s := range samples {
+		var pairs, base []string
+		for _, name := range s.LabelNames() {
+			pairs = append(pairs, promLabel(name, s.Labels[name]))
+			if name != "le" {
+				base = append(base, pairs[len(pairs)-1])
+			}
+		}
+		labels[i] = strings.Join(pairs, ",")
+		keys[i] = sortKey{family: s.Family(), labels: strings.Join(base, ",")}
+		if s.Histogram != "" {
+			switch s.Name {
+			case s.Histogram + "_bucket":
+				keys[i].le, _ = strconv.ParseFloat(s.Labels["le"], 64)
+			case s.Histogram + "_sum":
+				keys[i].series = 1
+			default:
+				keys[i].series = 2
+			}
+		}
+	}
+	idx := make([]int, len(samples))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		ka, kb := keys[idx[a]], keys[idx[b]]
+		switch {
+		case ka.family != kb.family:
+			return ka.family < kb.family
+		case ka.labels != kb.labels:
+			return ka.labels < kb.labels
+		case ka.series != kb.series:
+			return ka.series < kb.series
+		}
+		return ka.le < kb.le
+	})
+
+	p := &promWriter{w: w, meta: &metadataRegistry{}}
+	for _, i := range idx {
+		s := samples[i]
+		typ := "gauge"
+		switch {
+		case s.Histogram != "":
+			typ = "histogram"
+		case s.Counter:
+			typ = "counter"
+		}
+		p.series(s.Family(), s.Name, typ, labels[i], s.Value)
+	}
+	return p.err
+}
@@ -0,0 +1,117 @@
+package exphttp
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isBucketKey returns true for cumulative bucket keys like "latency.le_5ms" or
+// "methods.Svc.Get.request_size.le_1024".
+func (x *ExpPoller) isBucketKey(key string) bool {
+	sep := x.sep()
+	return strings.Contains(sep+key, sep+"le_")
+}
+
+// bucketBound parses the bound of a "le_" bucket label: a duration label such
+// as "5ms" (as nanoseconds), a plain number, or "inf".
+func bucketBound(label string) (float64, bool) {
+	if label == "inf" {
+		return math.Inf(1), true
+	}
+	if v, err := strconv.ParseFloat(label, 64); err == nil {
+		return v, true
+	}
+	if d, err := time.ParseDuration(label); err == nil {
+		return float64(d), true
+	}
+	return 0, false
+}
+
+// dropKey returns true if key is a raw bucket that DropBuckets skips.
+func (x *ExpPoller) dropKey(key string) bool {
+	return x.DropBuckets && len(x.Quantiles) > 0 && x.isBucketKey(key)
+}
+
+type bucket struct {
+	bound float64
+	count float64
+}
+
+// recordQuantiles estimates Quantiles for each set of cumulative buckets in r,
+// recording them as e.g. prefix+"latency.p99" alongside the buckets.
+func (x *ExpPoller) recordQuantiles(prefix string, r map[string]float64) {
+	if len(x.Quantiles) == 0 {
+		return
+	}
+	sep := x.sep()
+
+	sets := make(map[string][]bucket)
+	for key, val := range r {
+		k := sep + key
+		i := strings.LastIndex(k, sep+"le_")
+		if i < 0 {
+			continue
+		}
+		var metric string
+		if i > 0 {
+			metric = k[len(sep):i]
+		}
+		if bound, ok := bucketBound(k[i+len(sep)+3:]); ok {
+			sets[metric] = append(sets[metric], bucket{bound, val})
+		}
+	}
+
+	for metric, buckets := range sets {
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].bound < buckets[j].bound })
+		for _, q := range x.Quantiles {
+			v, ok := bucketQuantile(q, buckets)
+			if !ok {
+				continue
+			}
+			// p99.9 becomes p99_9 to keep separators out of the key
+			name := "p" + strings.ReplaceAll(strconv.FormatFloat(q*100, 'f', -1, 64), ".", "_")
+			if metric == "" {
+				x.record(prefix+name, v)
+			} else {
+				x.record(prefix+x.key(metric, name), v)
+			}
+		}
+	}
+}
+
+// bucketQuantile estimates quantile q (0-1) from sorted cumulative buckets,
+// interpolating linearly within the bucket that contains it. A quantile that
+// lands in the +Inf bucket is reported as the highest finite bound, since
+// nothing more is known about it. Returns false if there are no observations.
+func bucketQuantile(q float64, buckets []bucket) (float64, bool) {
+	if len(buckets) == 0 {
+		return 0, false
+	}
+	total := buckets[len(buckets)-1].count
+	if total <= 0 {
+		return 0, false
+	}
+
+	rank := q * total
+	var lowerBound, lowerCount float64
+	for i, b := range buckets {
+		if b.count < rank {
+			lowerBound, lowerCount = b.bound, b.count
+			continue
+		}
+		if math.IsInf(b.bound, 1) {
+			if i == 0 {
+				return 0, false
+			}
+			return buckets[i-1].bound, true
+		}
+		if b.count == lowerCount {
+			return b.bound, true
+		}
+		return lowerBound + (b.bound-lowerBound)*(rank-lowerCount)/(b.count-lowerCount), true
+	}
+	return buckets[len(buckets)-1].bound, true
+}
@@ -2,16 +2,35 @@ package exphttp
 
 import (
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // RateCounter is a thread-safe counter that allows you to count event rates
 // over time with minimal memory overhead.
+//
+// The interval is divided into gran bins, and a whole bin expires at once
+// when the counter rolls over. So an event is counted for between
+// interval-interval/gran and interval, and Rate may undercount by up to one
+// bin span at the trailing edge: with a 24h interval and gran 32 each bin
+// spans 45 minutes, so a burst can drop out up to 45 minutes early. Use
+// RateSmooth for a gradual decay at the window edge.
 type RateCounter struct {
-	others int64
-	bins   []int64
-	index  int
+	others  int64
+	last    int64
+	created int64
+	rolled  int64
+	expired int64
+	delta   int64
+	index   int64
+	bins    []int64
+
+	interval time.Duration
+	lazy     *sync.Once
+	stop     chan struct{}
+	stopOnce sync.Once
+	sched    *RateScheduler
 }
 
 // NewCounter makes a new RateCounter that never rolls over, effectively a
@@ -31,37 +50,240 @@ func NewRateCounter(interval time.Duration) *RateCounter {
 // rate is within an interval, at the expense of increased memory usage (one
 // int64 per gran number of "buckets").
 func NewRateCounterWithGranularity(interval time.Duration, gran int) *RateCounter {
+	r := newRateCounter(interval, gran)
+	if len(r.bins) > 1 {
+		go r.rollover()
+	}
+	return r
+}
+
+// NewLazyRateCounter makes a new RateCounter like NewRateCounter, but does not
+// start the background rollover goroutine until the first call to Add. This
+// avoids idle tickers when pre-allocating counters that may never be used.
+func NewLazyRateCounter(interval time.Duration) *RateCounter {
+	return NewLazyRateCounterWithGranularity(interval, DefaultGranularity)
+}
+
+// NewLazyRateCounterWithGranularity is the lazy equivalent of
+// NewRateCounterWithGranularity.
+func NewLazyRateCounterWithGranularity(interval time.Duration, gran int) *RateCounter {
+	r := newRateCounter(interval, gran)
+	if len(r.bins) > 1 {
+		r.lazy = &sync.Once{}
+	}
+	return r
+}
+
+// MinTickInterval is the smallest rollover tick used by RateCounter and
+// MovingAverage. Below this, OS timer resolution makes tickers fire
+// erratically, so granularity is clamped down so that interval/gran stays at or
+// above it.
+var MinTickInterval = time.Millisecond
+
+// clampGranularity reduces gran so that interval/gran >= MinTickInterval,
+// logging a warning to DefaultLogger if it had to.
+func clampGranularity(interval time.Duration, gran int) int {
+	if MinTickInterval <= 0 || interval/time.Duration(gran) >= MinTickInterval {
+		return gran
+	}
+	g := int(interval / MinTickInterval)
+	if g < 2 {
+		g = 2
+	}
+	if DefaultLogger != nil {
+		DefaultLogger.Printf("exphttp: interval %s too short for granularity %d, using %d", interval, gran, g)
+	}
+	return g
+}
+
+func newRateCounter(interval time.Duration, gran int) *RateCounter {
 	if interval <= time.Duration(0) || gran <= 1 {
 		return &RateCounter{
 			bins: []int64{0},
 		}
 	}
+	gran = clampGranularity(interval, gran)
 
-	r := &RateCounter{
-		bins: make([]int64, gran),
+	now := time.Now().UnixNano()
+	return &RateCounter{
+		created:  now,
+		rolled:   now,
+		bins:     make([]int64, gran),
+		interval: interval,
+		stop:     make(chan struct{}),
 	}
+}
 
-	go func() {
-		i := 0
-		t := time.NewTicker(interval / time.Duration(gran))
-		for range t.C {
-			i = r.index
-			r.index = (r.index + 1) % gran
-			r.others += r.bins[i] - atomic.SwapInt64(&r.bins[r.index], 0)
+func (r *RateCounter) rollover() {
+	t := time.NewTicker(r.step())
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
 		}
-	}()
+		r.tick()
+	}
+}
 
-	return r
+// step returns the time span covered by each bin.
+func (r *RateCounter) step() time.Duration {
+	return r.interval / time.Duration(len(r.bins))
+}
+
+// tick expires the oldest bin and moves on to the next. Only one goroutine
+// (the rollover or its scheduler) calls tick, but Add and Rate may run
+// concurrently, so index and others are only accessed atomically. others is
+// re-summed rather than adjusted, so an Add that lands in the previous bin
+// just after the move is picked up by the next tick rather than lost.
+func (r *RateCounter) tick() {
+	next := (atomic.LoadInt64(&r.index) + 1) % int64(len(r.bins))
+	old := atomic.SwapInt64(&r.bins[next], 0)
+	atomic.StoreInt64(&r.index, next)
+
+	var others int64
+	for i := range r.bins {
+		if int64(i) != next {
+			others += atomic.LoadInt64(&r.bins[i])
+		}
+	}
+	atomic.StoreInt64(&r.others, others)
+	atomic.StoreInt64(&r.expired, old)
+	atomic.StoreInt64(&r.rolled, time.Now().UnixNano())
+}
+
+// Stop halts the background rollover goroutine and its ticker, so counters
+// that are discarded (e.g. when handlers are re-created) don't leak them. It
+// is safe to call more than once. Add and Rate remain safe to call
+// afterwards, but the counter no longer rolls over, so counters registered
+// with expvar should not be stopped while still published.
+func (r *RateCounter) Stop() {
+	if r.sched != nil {
+		r.sched.remove(r)
+		return
+	}
+	if r.stop == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		if r.lazy != nil {
+			// never start the goroutine if it hasn't started already
+			r.lazy.Do(func() {})
+		}
+		close(r.stop)
+	})
+}
+
+func (r *RateCounter) start() {
+	go r.rollover()
 }
 
 // Add an even count into the RateCounter
 func (r *RateCounter) Add(val int64) {
-	atomic.AddInt64(&r.bins[r.index], val)
+	if r.lazy != nil {
+		r.lazy.Do(r.start)
+	}
+	atomic.AddInt64(&r.bins[atomic.LoadInt64(&r.index)], val)
+	atomic.AddInt64(&r.delta, val)
+	atomic.StoreInt64(&r.last, time.Now().UnixNano())
+}
+
+// Reset zeroes the counter, e.g. when new config is loaded, without
+// recreating it. It is safe to call concurrently with Add and rollover,
+// though events added during the call may or may not be cleared.
+func (r *RateCounter) Reset() {
+	for i := range r.bins {
+		atomic.StoreInt64(&r.bins[i], 0)
+	}
+	atomic.StoreInt64(&r.others, 0)
+	atomic.StoreInt64(&r.expired, 0)
+}
+
+// TakeDelta returns the count of events added since the previous call to
+// TakeDelta (or since the counter was created), and atomically resets it. This
+// suits push-based systems like StatsD counters that want increments per
+// flush, and doesn't affect Rate, so the same counter can also be published
+// with expvar.
+func (r *RateCounter) TakeDelta() int64 {
+	return atomic.SwapInt64(&r.delta, 0)
+}
+
+// LastEvent returns the time of the most recent call to Add, or the zero Time
+// if Add has never been called. Combined with Rate, this distinguishes an
+// idle stream from a stalled one.
+func (r *RateCounter) LastEvent() time.Time {
+	ns := atomic.LoadInt64(&r.last)
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
 }
 
 // Rate returns the current number of events in the last interval
 func (r *RateCounter) Rate() int64 {
-	return r.others + atomic.LoadInt64(&r.bins[r.index])
+	return atomic.LoadInt64(&r.others) + atomic.LoadInt64(&r.bins[atomic.LoadInt64(&r.index)])
+}
+
+// PerSecond returns Rate normalized to events per second over the interval.
+// Counters that never roll over return 0.
+func (r *RateCounter) PerSecond() float64 {
+	if r.interval <= 0 {
+		return 0
+	}
+	return float64(r.Rate()) / r.interval.Seconds()
+}
+
+// RateSmooth is like Rate, but also counts the most recently expired bin in
+// proportion to how much of it still falls within the last interval, assuming
+// its events were spread evenly. This gives a smooth decay at the edge of the
+// window, rather than Rate's drop of a whole bin at each rollover. Counters
+// that never roll over return Rate().
+func (r *RateCounter) RateSmooth() int64 {
+	rate := r.Rate()
+	if len(r.bins) <= 1 {
+		return rate
+	}
+
+	step := r.step()
+	elapsed := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&r.rolled))
+	if elapsed >= step {
+		return rate
+	}
+	frac := 1 - float64(elapsed)/float64(step)
+	return rate + int64(float64(atomic.LoadInt64(&r.expired))*frac)
+}
+
+// ProjectedRate extrapolates the events counted so far in the current window
+// to an estimate for a full interval, based on how much of the window has
+// elapsed since the counter was created and since the last rollover. This is
+// noisy early in a window (a few events extrapolated a long way) and smooths
+// out as the window fills. Counters that never roll over return Rate().
+func (r *RateCounter) ProjectedRate() int64 {
+	rate := r.Rate()
+	if len(r.bins) <= 1 {
+		return rate
+	}
+
+	now := time.Now().UnixNano()
+	covered := time.Duration(now-atomic.LoadInt64(&r.rolled)) + r.step()*time.Duration(len(r.bins)-1)
+	if age := time.Duration(now - r.created); age < covered {
+		covered = age
+	}
+	if covered <= 0 {
+		return rate
+	}
+	return int64(float64(rate) * float64(r.interval) / float64(covered))
+}
+
+// MarshalJSON implements json.Marshaler, encoding the rate along with its
+// interval so consumers can tell it apart from a plain counter, e.g.
+//
+//	{"rate": 42, "interval_ns": 60000000000}
+//
+// String is unchanged, so expvar still publishes the bare number.
+func (r *RateCounter) MarshalJSON() ([]byte, error) {
+	return []byte(`{"rate": ` + r.String() + `, "interval_ns": ` + strconv.FormatInt(int64(r.interval), 10) + `}`), nil
 }
 
 // String returns Rate() as a string (to implement expvar.Var)
@@ -0,0 +1,88 @@
+package exphttp
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRateCounterConcurrentRollover is meant to be run with -race.
+func TestRateCounterConcurrentRollover(t *testing.T) {
+	r := NewRateCounterWithGranularity(20*time.Millisecond, 4)
+	defer r.Stop()
+
+	var wg sync.WaitGroup
+	var added int64
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					atomic.AddInt64(&added, 1)
+					r.Add(1)
+				}
+			}
+		}()
+	}
+
+	// at least two rollovers of the 5ms bins
+	start := atomic.LoadInt64(&r.rolled)
+	deadline := time.Now().Add(time.Second)
+	for rolls := 0; rolls < 2 && time.Now().Before(deadline); {
+		// read added after Rate, since it is incremented before each Add
+		rate := r.Rate()
+		if max := atomic.LoadInt64(&added); rate < 0 || rate > max {
+			t.Errorf("Rate() = %d, want 0-%d", rate, max)
+			break
+		}
+		if rolled := atomic.LoadInt64(&r.rolled); rolled != start {
+			start = rolled
+			rolls++
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if atomic.LoadInt64(&r.rolled) == r.created {
+		t.Fatal("counter never rolled over")
+	}
+}
+
+func TestRateCounterReset(t *testing.T) {
+	// no rollover goroutine, so the test drives tick itself
+	r := newRateCounter(time.Hour, 4)
+	for i := 0; i < 4; i++ {
+		r.Add(10)
+		r.tick()
+	}
+	r.Add(5)
+	if got := r.Rate(); got != 35 {
+		t.Fatalf("Rate() = %d before Reset, want 35", got)
+	}
+
+	r.Reset()
+	if got := r.Rate(); got != 0 {
+		t.Errorf("Rate() = %d after Reset, want 0", got)
+	}
+	if got := r.RateSmooth(); got != 0 {
+		t.Errorf("RateSmooth() = %d after Reset, want 0", got)
+	}
+}
+
+func TestRateCounterPerSecond(t *testing.T) {
+	r := newRateCounter(2*time.Minute, DefaultGranularity)
+	r.Add(240)
+	if got, want := r.PerSecond(), float64(r.Rate())/120; got != want || got != 2 {
+		t.Errorf("PerSecond() = %v, want Rate()/120 = %v", got, want)
+	}
+
+	if got := NewCounter().PerSecond(); got != 0 {
+		t.Errorf("PerSecond() = %v for a counter that never rolls over, want 0", got)
+	}
+}
@@ -6,19 +6,34 @@ import (
 	"expvar"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	rpcStats *expvar.Map
-	reqRate  *RateCounter
-	respRate *RateCounter
+	rpcStats   *expvar.Map
+	rpcServers *expvar.Map
+	reqRate    *RateCounter
+	respRate   *RateCounter
 )
 
 // ExpRPCServer is a wrapped rpc.Server that exposes timing info and request
 // stats for all the RPC calls going through a rpc.Server.
+//
+// Alongside the per-method "requests.<Service.Method>" counts, calls are
+// aggregated per service in "requests.<Service>" and "responses.<Service>".
+//
+// Timing assumes one response per request, as net/rpc does. If a custom codec
+// writes several responses for the same request Seq, the first is timed as
+// usual and the rest are only counted in "responses.<method>.chunks".
 type ExpRPCServer struct {
 	srv *rpc.Server
 
@@ -31,43 +46,428 @@ type ExpRPCServer struct {
 	// Log requests to this logger if non-nil.
 	Log *log.Logger
 
-	rates      map[string]*RateCounter
-	startTimes map[uint64]time.Time
+	// SlowThreshold, if non-zero, only logs responses that took longer than
+	// this to Log, and counts them in "responses.slow". All responses are
+	// still recorded in the other stats.
+	SlowThreshold time.Duration
+
+	// RateTTL, if non-zero, removes per-method rate counters for methods that
+	// have not seen a request within this duration. Methods given to
+	// DeclareMethods are exempt. Only parsed once in the first incoming
+	// request.
+	RateTTL time.Duration
+
+	// RateCap, if non-zero, limits the number of per-method rate counters. When
+	// full, the least recently used counter is removed to make room.
+	RateCap int
+
+	// SizeBuckets, if non-nil, enables per-method Histograms of request and
+	// response sizes in bytes, using these bucket boundaries. They are
+	// published as "methods.<method>.request_size" and
+	// "methods.<method>.response_size", whose buckets, count and sum are all
+	// polled as counters.
+	SizeBuckets []int64
+
+	// RecordWait splits each response's elapsed time into
+	// "responses.<method>.wait_ns", from reading the request header until the
+	// request body is decoded and the method is dispatched, and
+	// "responses.<method>.exec_ns", from dispatch until the response is
+	// written.
+	RecordWait bool
+
+	// ErrorRates enables a rolling per-method error rate, published as
+	// "responses.<method>.error_rate_per_<IntervalLabel>": the percentage of
+	// the method's responses within the last Interval that were errors. It
+	// is removed along with the method's request rate by RateTTL and RateCap.
+	ErrorRates bool
+
+	// ErrorClassifier, if non-nil, maps each error response to a category
+	// such as "not_found", counted in "responses.error.<category>". At most
+	// 16 distinct categories are tracked, with the rest (and empty ones)
+	// counted under "responses.error.other".
+	ErrorClassifier func(method, errStr string) string
+
+	// ClientStats enables per-client request counts, recorded as
+	// "requests.by_client.<addr>" using the remote host of each connection
+	// (without the port, which changes per connection). Dots in addresses
+	// become underscores. Connections without a remote address are counted
+	// under "requests.by_client.other".
+	ClientStats bool
+
+	// MaxClients caps the number of distinct clients tracked by ClientStats,
+	// admitting the first ones seen and counting the rest under
+	// "requests.by_client.other". Defaults to 1024 if zero.
+	MaxClients int
+
+	sep         string
+	stats       *expvar.Map
+	reqRate     *RateCounter
+	respRate    *RateCounter
+	sched       *RateScheduler
+	nowFunc     func() time.Time
+	mu          sync.Mutex
+	methods     map[string]bool
+	declared    map[string]bool
+	sizes       map[string]*Histogram
+	rates       map[string]*RateCounter
+	errRates    map[string]*errorRate
+	clients     *labelCap
+	errorKinds  *labelCap
+	cleanupOnce sync.Once
+
+	// startTimes and dispatched are guarded by timesMu rather than mu, as
+	// they're touched on every call by every connection's goroutine.
+	timesMu    sync.Mutex
+	startTimes map[callKey]time.Time
+	dispatched map[callKey]time.Time
+	conns      uint64
 }
 
-func (w *ExpRPCServer) recordRequest(r *rpc.Request) {
-	reqRate.Add(1)
-	rpcStats.Add("requests", 1)
-	rpcStats.Add("requests."+r.ServiceMethod, 1)
-	rc, found := w.rates[r.ServiceMethod]
-	if !found {
-		rc = NewRateCounter(w.Interval)
-		w.rates[r.ServiceMethod] = rc
-		rpcStats.Set("requests."+r.ServiceMethod+".per_"+w.IntervalLabel, rc)
+// callKey identifies an in-flight call. Clients number their calls per
+// connection, so the Seq alone collides between connections.
+type callKey struct {
+	conn uint64
+	seq  uint64
+}
+
+// newConnID returns a unique id for a new codec's calls.
+func (w *ExpRPCServer) newConnID() uint64 {
+	return atomic.AddUint64(&w.conns, 1)
+}
+
+func (w *ExpRPCServer) recordRequest(conn uint64, client string, r *rpc.Request) {
+	w.reqRate.Add(1)
+	w.stats.Add("requests", 1)
+	w.stats.Add(w.key("requests", r.ServiceMethod), 1)
+	if svc, ok := serviceName(r.ServiceMethod); ok {
+		w.stats.Add(w.key("requests", svc), 1)
 	}
+	if w.ClientStats {
+		w.stats.Add(w.key("requests", "by_client", w.clientLabel(client)), 1)
+	}
+	if w.RateTTL > 0 {
+		w.cleanupOnce.Do(func() { go w.cleanupRates() })
+	}
+
+	w.mu.Lock()
+	w.methods[r.ServiceMethod] = true
+	rc := w.methodRate(r.ServiceMethod)
+	w.mu.Unlock()
+
 	rc.Add(1)
-	w.startTimes[r.Seq] = time.Now()
+	now := w.now()
+	w.timesMu.Lock()
+	w.startTimes[callKey{conn, r.Seq}] = now
+	w.timesMu.Unlock()
+}
+
+// clientLabel returns the stat label for a client address, collapsing it into
+// "other" once MaxClients are tracked.
+func (w *ExpRPCServer) clientLabel(client string) string {
+	w.mu.Lock()
+	if w.clients == nil {
+		max := w.MaxClients
+		if max <= 0 {
+			max = 1024
+		}
+		w.clients = newLabelCap(max)
+	}
+	clients := w.clients
+	w.mu.Unlock()
+	return clients.get(client)
+}
+
+// errorCategory returns the stat label for an error response, collapsing it
+// into "other" once 16 categories are tracked.
+func (w *ExpRPCServer) errorCategory(method, errStr string) string {
+	w.mu.Lock()
+	if w.errorKinds == nil {
+		w.errorKinds = newLabelCap(16)
+	}
+	kinds := w.errorKinds
+	w.mu.Unlock()
+	return kinds.get(sanitizeLabel(w.ErrorClassifier(method, errStr), w.sep))
+}
+
+// remoteClient returns the sanitized remote host of conn, or "other" if it
+// doesn't have one.
+func (w *ExpRPCServer) remoteClient(conn io.ReadWriteCloser) string {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok && c.RemoteAddr() != nil {
+		return sanitizeLabel(stripPort(c.RemoteAddr().String()), w.sep)
+	}
+	return "other"
+}
+
+// methodRate returns the request rate counter for method, creating and
+// publishing it if needed. Must be called with w.mu held.
+func (w *ExpRPCServer) methodRate(method string) *RateCounter {
+	rc, found := w.rates[method]
+	if !found {
+		if w.RateCap > 0 && len(w.rates) >= w.RateCap {
+			w.evictOldestRate()
+		}
+		rc = w.newRateCounter(w.Interval)
+		w.rates[method] = rc
+		w.stats.Set(w.rateKey(method), rc)
+	}
+	return rc
+}
+
+// DeclareMethods pre-registers the "requests.<method>", "responses.<method>"
+// and "responses.<method>.total_ns" stats at zero, along with the method's
+// rate counter, so that the series exist from startup instead of appearing on
+// the first call. Methods are given as "Service.Method". Methods that aren't
+// declared are still tracked when first called. Declared rate counters are
+// kept through idle periods rather than removed by RateTTL, but are still
+// subject to RateCap.
+func (w *ExpRPCServer) DeclareMethods(methods ...string) {
+	for _, method := range methods {
+		w.stats.Add(w.key("requests", method), 0)
+		w.stats.Add(w.key("responses", method), 0)
+		w.stats.Add(w.key("responses", method, "total_ns"), 0)
+
+		w.mu.Lock()
+		w.methods[method] = true
+		w.declared[method] = true
+		w.methodRate(method)
+		w.mu.Unlock()
+	}
+}
+
+// serviceName returns the service part of a "Service.Method" name.
+func serviceName(serviceMethod string) (string, bool) {
+	i := strings.LastIndex(serviceMethod, ".")
+	if i <= 0 {
+		return "", false
+	}
+	return serviceMethod[:i], true
+}
+
+// MethodStats is a point-in-time snapshot of the stats for one RPC method.
+type MethodStats struct {
+	Method    string
+	Requests  int64
+	Responses int64
+	Errors    int64
+	TotalNs   int64
+	AvgNs     int64
+	InFlight  int64
+}
+
+// Snapshot returns the current stats for every method this server has seen,
+// sorted by method name.
+func (w *ExpRPCServer) Snapshot() []MethodStats {
+	w.mu.Lock()
+	res := make([]MethodStats, 0, len(w.methods))
+	for method := range w.methods {
+		m := MethodStats{
+			Method:    method,
+			Requests:  w.intStat("requests", method),
+			Responses: w.intStat("responses", method),
+			Errors:    w.intStat("responses", method, "error"),
+			TotalNs:   w.intStat("responses", method, "total_ns"),
+		}
+		if m.Responses > 0 {
+			m.AvgNs = m.TotalNs / m.Responses
+		}
+		m.InFlight = m.Requests - m.Responses
+		res = append(res, m)
+	}
+	w.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Method < res[j].Method })
+	return res
+}
+
+// intStat returns the value of an expvar.Int stat, or 0 if not present.
+func (w *ExpRPCServer) intStat(parts ...string) int64 {
+	if v, ok := w.stats.Get(w.key(parts...)).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// now returns the current time from nowFunc, which tests may replace with a
+// controllable clock.
+func (w *ExpRPCServer) now() time.Time {
+	if w.nowFunc != nil {
+		return w.nowFunc()
+	}
+	return time.Now()
+}
+
+// key joins parts of a stat key with the server's separator.
+func (w *ExpRPCServer) key(parts ...string) string {
+	return strings.Join(parts, w.sep)
+}
+
+// recordSize observes a request or response size for method, where kind is
+// "request" or "response".
+func (w *ExpRPCServer) recordSize(method, kind string, size int64) {
+	if w.SizeBuckets == nil {
+		return
+	}
+	key := w.key("methods", method, kind+"_size")
+	w.mu.Lock()
+	h, found := w.sizes[key]
+	if !found {
+		h = NewHistogram(w.SizeBuckets)
+		w.sizes[key] = h
+		w.stats.Set(key, h)
+	}
+	w.mu.Unlock()
+	h.Observe(size)
+}
+
+func (w *ExpRPCServer) rateKey(method string) string {
+	return w.key("requests", method, "per_"+w.IntervalLabel)
+}
+
+func (w *ExpRPCServer) errorRateKey(method string) string {
+	return w.key("responses", method, "error_rate_per_"+w.IntervalLabel)
+}
+
+// errorRate is a pair of RateCounters for the errors and total responses of
+// one method. Its String method (to implement expvar.Var) returns the errors
+// as a percentage of the total.
+type errorRate struct {
+	errors *RateCounter
+	total  *RateCounter
+}
+
+func (e *errorRate) String() string {
+	pct := percent(float64(e.errors.Rate()), float64(e.total.Rate()))
+	return strconv.FormatFloat(pct, 'f', -1, 64)
+}
+
+// recordErrorRate adds a response for method to its errorRate, creating it
+// if needed.
+func (w *ExpRPCServer) recordErrorRate(method string, isErr bool) {
+	w.mu.Lock()
+	er, found := w.errRates[method]
+	if !found {
+		er = &errorRate{
+			errors: w.newRateCounter(w.Interval),
+			total:  w.newRateCounter(w.Interval),
+		}
+		w.errRates[method] = er
+		w.stats.Set(w.errorRateKey(method), er)
+	}
+	w.mu.Unlock()
+
+	er.total.Add(1)
+	if isErr {
+		er.errors.Add(1)
+	}
+}
+
+// evictOldestRate removes the least recently used rate counter. Must be called
+// with w.mu held.
+func (w *ExpRPCServer) evictOldestRate() {
+	var oldest string
+	var oldestTime time.Time
+	for method, rc := range w.rates {
+		if t := rc.LastEvent(); oldest == "" || t.Before(oldestTime) {
+			oldest, oldestTime = method, t
+		}
+	}
+	w.removeRate(oldest)
+}
+
+// removeRate stops and unpublishes the rate counter for method. Must be
+// called with w.mu held.
+func (w *ExpRPCServer) removeRate(method string) {
+	rc, found := w.rates[method]
+	if !found {
+		return
+	}
+	delete(w.rates, method)
+	w.stats.Delete(w.rateKey(method))
+	rc.Stop()
+
+	if er, found := w.errRates[method]; found {
+		delete(w.errRates, method)
+		w.stats.Delete(w.errorRateKey(method))
+		er.errors.Stop()
+		er.total.Stop()
+	}
+}
+
+// cleanupRates periodically removes rate counters that have been idle for
+// longer than RateTTL, other than those of declared methods.
+func (w *ExpRPCServer) cleanupRates() {
+	t := time.NewTicker(w.RateTTL)
+	defer t.Stop()
+	for now := range t.C {
+		w.mu.Lock()
+		for method, rc := range w.rates {
+			if !w.declared[method] && now.Sub(rc.LastEvent()) > w.RateTTL {
+				w.removeRate(method)
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// recordDispatch stamps the time a request is handed to its method.
+func (w *ExpRPCServer) recordDispatch(conn, seq uint64) {
+	if w.RecordWait {
+		now := w.now()
+		w.timesMu.Lock()
+		w.dispatched[callKey{conn, seq}] = now
+		w.timesMu.Unlock()
+	}
 }
 
-func (w *ExpRPCServer) recordResponse(r *rpc.Response) {
-	elapsed := time.Now().Sub(w.startTimes[r.Seq]).Nanoseconds()
+func (w *ExpRPCServer) recordResponse(conn uint64, r *rpc.Response) {
+	k := callKey{conn, r.Seq}
+	w.timesMu.Lock()
+	start, found := w.startTimes[k]
+	dispatched, wasDispatched := w.dispatched[k]
+	delete(w.startTimes, k)
+	delete(w.dispatched, k)
+	w.timesMu.Unlock()
+	if !found {
+		// already answered, so this is a streamed chunk from a custom codec.
+		w.stats.Add(w.key("responses", r.ServiceMethod, "chunks"), 1)
+		return
+	}
+	now := w.now()
+	elapsed := now.Sub(start).Nanoseconds()
 
-	respRate.Add(1)
-	rpcStats.Add("responses", 1)
-	rpcStats.Add("responses.total_ns", elapsed)
-	rpcStats.Add("responses."+r.ServiceMethod, 1)
-	rpcStats.Add("responses."+r.ServiceMethod+".total_ns", elapsed)
+	w.respRate.Add(1)
+	w.stats.Add("responses", 1)
+	w.stats.Add(w.key("responses", "total_ns"), elapsed)
+	w.stats.Add(w.key("responses", r.ServiceMethod), 1)
+	w.stats.Add(w.key("responses", r.ServiceMethod, "total_ns"), elapsed)
+	if svc, ok := serviceName(r.ServiceMethod); ok {
+		w.stats.Add(w.key("responses", svc), 1)
+	}
 	if r.Error != "" {
-		rpcStats.Add("responses.error", 1)
-		rpcStats.Add("responses.error.total_ns", elapsed)
+		w.stats.Add(w.key("responses", "error"), 1)
+		w.stats.Add(w.key("responses", "error", "total_ns"), elapsed)
 
-		rpcStats.Add("responses."+r.ServiceMethod+".error", 1)
-		rpcStats.Add("responses."+r.ServiceMethod+".error.total_ns", elapsed)
+		w.stats.Add(w.key("responses", r.ServiceMethod, "error"), 1)
+		w.stats.Add(w.key("responses", r.ServiceMethod, "error", "total_ns"), elapsed)
+
+		if w.ErrorClassifier != nil {
+			w.stats.Add(w.key("responses", "error", w.errorCategory(r.ServiceMethod, r.Error)), 1)
+		}
+	}
+	if w.RecordWait && wasDispatched {
+		w.stats.Add(w.key("responses", r.ServiceMethod, "wait_ns"), dispatched.Sub(start).Nanoseconds())
+		w.stats.Add(w.key("responses", r.ServiceMethod, "exec_ns"), now.Sub(dispatched).Nanoseconds())
+	}
+	if w.ErrorRates {
+		w.recordErrorRate(r.ServiceMethod, r.Error != "")
+	}
+	slow := w.SlowThreshold > 0 && elapsed > w.SlowThreshold.Nanoseconds()
+	if slow {
+		w.stats.Add(w.key("responses", "slow"), 1)
 	}
-	if w.Log != nil {
+	if w.Log != nil && (slow || w.SlowThreshold == 0) {
 		w.Log.Println(float64(elapsed)/1000000.0, "ms --", r.ServiceMethod, "--", r.Error)
 	}
-	delete(w.startTimes, r.Seq)
 }
 
 // NewRPCServer creates a new ExpRPCServer wrapping a rpc.Server, publishes a
@@ -85,26 +485,157 @@ func NewRPCServer(srv *rpc.Server) *ExpRPCServer {
 		rpcStats = expvar.NewMap("exprpc")
 		reqRate = NewRateCounter(time.Minute)
 		respRate = NewRateCounter(time.Minute)
-		rpcStats.Set("requests.per_min", reqRate)
-		rpcStats.Set("responses.per_min", respRate)
+		rpcStats.Set("requests"+KeySeparator+"per_min", reqRate)
+		rpcStats.Set("responses"+KeySeparator+"per_min", respRate)
 	}
 
-	e := &ExpRPCServer{
+	return newRPCServer(srv, rpcStats, reqRate, respRate, nil)
+}
+
+// NewNamedRPCServer creates a new ExpRPCServer like NewRPCServer, but
+// publishes its stats in a new expvar.Map with the given name instead of the
+// shared "exprpc" map, and adds name to the exposed "exprpcs" map so that
+// stats polling code can auto-discover. This allows several rpc.Servers in
+// one process to be tracked independently.
+//
+// If sched is non-nil, all of the server's rate counters are rolled over by
+// it, so many servers can share a single background goroutine.
+func NewNamedRPCServer(name string, srv *rpc.Server, sched *RateScheduler) *ExpRPCServer {
+	if rpcServers == nil {
+		rpcServers = expvar.NewMap("exprpcs")
+	}
+	stats := expvar.NewMap(name)
+
+	e := newRPCServer(srv, stats, nil, nil, sched)
+	e.reqRate = e.newRateCounter(time.Minute)
+	e.respRate = e.newRateCounter(time.Minute)
+	stats.Set(e.key("requests", "per_min"), e.reqRate)
+	stats.Set(e.key("responses", "per_min"), e.respRate)
+
+	rpcServers.Add(name, 1)
+	return e
+}
+
+func newRPCServer(srv *rpc.Server, stats *expvar.Map, reqRate, respRate *RateCounter, sched *RateScheduler) *ExpRPCServer {
+	return &ExpRPCServer{
 		srv:           srv,
 		IntervalLabel: "min",
 		Interval:      time.Minute,
 		Log:           DefaultLogger,
 
+		sep:        KeySeparator,
+		stats:      stats,
+		reqRate:    reqRate,
+		respRate:   respRate,
+		sched:      sched,
+		nowFunc:    time.Now,
+		methods:    make(map[string]bool),
+		declared:   make(map[string]bool),
+		sizes:      make(map[string]*Histogram),
 		rates:      make(map[string]*RateCounter),
-		startTimes: make(map[uint64]time.Time),
+		errRates:   make(map[string]*errorRate),
+		startTimes: make(map[callKey]time.Time),
+		dispatched: make(map[callKey]time.Time),
 	}
+}
 
-	return e
+func (w *ExpRPCServer) newRateCounter(interval time.Duration) *RateCounter {
+	if w.sched != nil {
+		return w.sched.NewRateCounter(interval)
+	}
+	return NewRateCounter(interval)
+}
+
+// NewJSONRPCCodec returns a net/rpc/jsonrpc server codec for conn that
+// records the same stats as HandleFunc, for serving JSON-RPC with:
+//
+//     go srv.ServeCodec(expServer.NewJSONRPCCodec(conn))
+//
+// Request and response sizes are not recorded, because the JSON decoder
+// reads ahead of each request.
+func (x *ExpRPCServer) NewJSONRPCCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &wrappedServerCodec{
+		exp:    x,
+		codec:  jsonrpc.NewServerCodec(conn),
+		conn:   x.newConnID(),
+		client: x.remoteClient(conn),
+	}
+}
+
+// wrappedServerCodec records stats around another rpc.ServerCodec. The
+// jsonrpc codec replaces each request's id with its own sequence number
+// while reading the header and maps it back while writing the response, so
+// the stats are recorded between those steps, where r.Seq is the codec's
+// number in both directions.
+type wrappedServerCodec struct {
+	exp    *ExpRPCServer
+	codec  rpc.ServerCodec
+	conn   uint64
+	client string
+	seq    uint64
+}
+
+func (c *wrappedServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.codec.ReadRequestHeader(r)
+	if err != nil {
+		return err
+	}
+	c.exp.recordRequest(c.conn, c.client, r)
+	c.seq = r.Seq
+	return nil
+}
+
+func (c *wrappedServerCodec) ReadRequestBody(body interface{}) error {
+	err := c.codec.ReadRequestBody(body)
+	c.exp.recordDispatch(c.conn, c.seq)
+	return err
+}
+
+func (c *wrappedServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.exp.recordResponse(c.conn, r)
+	return c.codec.WriteResponse(r, body)
+}
+
+func (c *wrappedServerCodec) Close() error {
+	return c.codec.Close()
 }
 
 ////////////////////////////
 // below this line copied over from unexported stdlib methods and minimally tweaked
 
+// countingReader counts bytes read. It implements io.ByteReader so that
+// gob.Decoder reads through it exactly instead of adding its own buffering.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// countingWriter counts bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
 type gobServerCodec struct {
 	exp *ExpRPCServer
 
@@ -113,20 +644,60 @@ type gobServerCodec struct {
 	enc    *gob.Encoder
 	encBuf *bufio.Writer
 	closed bool
+
+	in     *countingReader
+	out    *countingWriter
+	conn   uint64
+	client string
+	method string
+	seq    uint64
+}
+
+func newGobServerCodec(exp *ExpRPCServer, conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	in := &countingReader{r: bufio.NewReader(conn)}
+	out := &countingWriter{w: buf}
+	return &gobServerCodec{
+		exp:    exp,
+		rwc:    conn,
+		dec:    gob.NewDecoder(in),
+		enc:    gob.NewEncoder(out),
+		encBuf: buf,
+		in:     in,
+		out:    out,
+		conn:   exp.newConnID(),
+		client: exp.remoteClient(conn),
+	}
 }
 
 func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.in.n = 0
 	err := c.dec.Decode(r)
-	c.exp.recordRequest(r)
-	return err
+	if err != nil {
+		// usually io.EOF as the client hangs up, so there's no request
+		return err
+	}
+	c.exp.recordRequest(c.conn, c.client, r)
+	c.method, c.seq = r.ServiceMethod, r.Seq
+	return nil
 }
 
 func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
-	return c.dec.Decode(body)
+	err := c.dec.Decode(body)
+	c.exp.recordSize(c.method, "request", c.in.n)
+	// net/rpc dispatches the method as soon as the body is read
+	c.exp.recordDispatch(c.conn, c.seq)
+	return err
 }
 
 func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
-	c.exp.recordResponse(r)
+	c.exp.recordResponse(c.conn, r)
+	c.out.n = 0
+	defer func() {
+		if err == nil {
+			c.exp.recordSize(r.ServiceMethod, "response", c.out.n)
+		}
+	}()
 
 	if err = c.enc.Encode(r); err != nil {
 		if c.encBuf.Flush() == nil {
@@ -185,13 +756,19 @@ func (x *ExpRPCServer) HandleFunc(w http.ResponseWriter, req *http.Request) {
 	}
 	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
 
-	buf := bufio.NewWriter(conn)
-	codec := &gobServerCodec{
-		exp:    x,
-		rwc:    conn,
-		dec:    gob.NewDecoder(conn),
-		enc:    gob.NewEncoder(buf),
-		encBuf: buf,
-	}
-	x.srv.ServeCodec(codec)
+	x.srv.ServeCodec(newGobServerCodec(x, conn))
+}
+
+// ServeConn runs the wrapped rpc.Server on a single connection, tracking
+// timing info via expvars. It's the same as rpc.ServeConn, so it blocks
+// until the client hangs up and is usually run in a goroutine:
+//
+//     for {
+//         conn, err := l.Accept()
+//         ...
+//         go expServer.ServeConn(conn)
+//     }
+//
+func (x *ExpRPCServer) ServeConn(conn io.ReadWriteCloser) {
+	x.srv.ServeCodec(newGobServerCodec(x, conn))
 }
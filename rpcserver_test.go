@@ -0,0 +1,38 @@
+package exphttp
+
+import (
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestRateTTLKeepsDeclaredMethods(t *testing.T) {
+	w := NewNamedRPCServer("test_rate_ttl", rpc.NewServer(), nil)
+	w.RateTTL = 5 * time.Millisecond
+	w.DeclareMethods("Svc.Declared")
+	w.mu.Lock()
+	w.methodRate("Svc.Called")
+	w.mu.Unlock()
+
+	go w.cleanupRates()
+	deadline := time.Now().Add(time.Second)
+	for {
+		w.mu.Lock()
+		_, called := w.rates["Svc.Called"]
+		_, declared := w.rates["Svc.Declared"]
+		w.mu.Unlock()
+		if !declared {
+			t.Fatal("declared method's rate counter removed by RateTTL")
+		}
+		if !called {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle undeclared rate counter not removed by RateTTL")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w.stats.Get(w.rateKey("Svc.Declared")) == nil {
+		t.Error("declared method's rate unpublished")
+	}
+}
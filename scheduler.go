@@ -0,0 +1,81 @@
+package exphttp
+
+import (
+	"sync"
+	"time"
+)
+
+// RateScheduler rolls over many RateCounters from a single background
+// goroutine, instead of one goroutine and ticker per counter. Counters are
+// rolled over on the first scheduler tick after each of their bins expires,
+// so the resolution should be well below the counters' interval/granularity.
+type RateScheduler struct {
+	mu       sync.Mutex
+	counters map[*RateCounter]time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewRateScheduler creates a RateScheduler and starts its goroutine, ticking
+// at the resolution given.
+func NewRateScheduler(resolution time.Duration) *RateScheduler {
+	s := &RateScheduler{
+		counters: make(map[*RateCounter]time.Time),
+		stop:     make(chan struct{}),
+	}
+	go s.run(resolution)
+	return s
+}
+
+// NewRateCounter makes a new RateCounter rolled over by s, using the interval
+// provided and DefaultGranularity.
+func (s *RateScheduler) NewRateCounter(interval time.Duration) *RateCounter {
+	return s.NewRateCounterWithGranularity(interval, DefaultGranularity)
+}
+
+// NewRateCounterWithGranularity makes a new RateCounter rolled over by s,
+// using the interval and granularity settings provided.
+func (s *RateScheduler) NewRateCounterWithGranularity(interval time.Duration, gran int) *RateCounter {
+	r := newRateCounter(interval, gran)
+	if len(r.bins) > 1 {
+		r.sched = s
+		s.mu.Lock()
+		s.counters[r] = time.Now().Add(r.step())
+		s.mu.Unlock()
+	}
+	return r
+}
+
+// Stop halts the scheduler goroutine. Its counters no longer roll over.
+func (s *RateScheduler) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func (s *RateScheduler) remove(r *RateCounter) {
+	s.mu.Lock()
+	delete(s.counters, r)
+	s.mu.Unlock()
+}
+
+func (s *RateScheduler) run(resolution time.Duration) {
+	t := time.NewTicker(resolution)
+	defer t.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-s.stop:
+			return
+		case now = <-t.C:
+		}
+
+		s.mu.Lock()
+		for r, next := range s.counters {
+			for !now.Before(next) {
+				r.tick()
+				next = next.Add(r.step())
+			}
+			s.counters[r] = next
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,201 @@
+package exphttp
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricSink is an exporter seam for sending exphttp metrics to another
+// metrics system (e.g. an OpenTelemetry meter) without exphttp depending on
+// it directly. Names are the dotted keys produced by ExpPoller, prefixed by
+// the plugin name.
+type MetricSink interface {
+	// Counter records the current cumulative value of a monotonic counter.
+	Counter(name string, value float64)
+
+	// Gauge records the current value of a metric that can go up or down.
+	Gauge(name string, value float64)
+
+	// Histogram records a single observation into a distribution. ExpPoller
+	// does not produce observations itself, but live exporters may.
+	Histogram(name string, value float64)
+}
+
+// NopSink is a MetricSink that discards everything.
+type NopSink struct{}
+
+// Counter implements MetricSink.
+func (NopSink) Counter(name string, value float64) {}
+
+// Gauge implements MetricSink.
+func (NopSink) Gauge(name string, value float64) {}
+
+// Histogram implements MetricSink.
+func (NopSink) Histogram(name string, value float64) {}
+
+// MapSink is a simple thread-safe MetricSink that keeps the latest value of
+// each counter and gauge, and every histogram observation, in memory.
+type MapSink struct {
+	mu         sync.Mutex
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string][]float64
+}
+
+// NewMapSink creates an empty MapSink.
+func NewMapSink() *MapSink {
+	return &MapSink{
+		counters:   make(map[string]float64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string][]float64),
+	}
+}
+
+// Counter implements MetricSink.
+func (m *MapSink) Counter(name string, value float64) {
+	m.mu.Lock()
+	m.counters[name] = value
+	m.mu.Unlock()
+}
+
+// Gauge implements MetricSink.
+func (m *MapSink) Gauge(name string, value float64) {
+	m.mu.Lock()
+	m.gauges[name] = value
+	m.mu.Unlock()
+}
+
+// Histogram implements MetricSink.
+func (m *MapSink) Histogram(name string, value float64) {
+	m.mu.Lock()
+	m.histograms[name] = append(m.histograms[name], value)
+	m.mu.Unlock()
+}
+
+// Counters returns a copy of the latest counter values.
+func (m *MapSink) Counters() map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]float64, len(m.counters))
+	for k, v := range m.counters {
+		res[k] = v
+	}
+	return res
+}
+
+// Gauges returns a copy of the latest gauge values.
+func (m *MapSink) Gauges() map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]float64, len(m.gauges))
+	for k, v := range m.gauges {
+		res[k] = v
+	}
+	return res
+}
+
+// Histograms returns a copy of all histogram observations.
+func (m *MapSink) Histograms() map[string][]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string][]float64, len(m.histograms))
+	for k, v := range m.histograms {
+		res[k] = append([]float64(nil), v...)
+	}
+	return res
+}
+
+// SinkRecordFunc returns a RecordFunc for x that forwards every polled value
+// to sink, as a Counter for cumulative keys (requests, responses, totals) and as
+// a Gauge for everything else (rates, averages, memory sizes).
+func SinkRecordFunc(x *ExpPoller, sink MetricSink) func(key string, val interface{}) {
+	return func(key string, val interface{}) {
+		v, ok := toFloat(val)
+		if !ok {
+			return
+		}
+		name := x.key(x.PluginName, key)
+		if isCounterKey(key, x.sep()) {
+			sink.Counter(name, v)
+		} else {
+			sink.Gauge(name, v)
+		}
+	}
+}
+
+// PrefixedRecordFunc returns a RecordFunc that prepends prefix to each key
+// before passing it on to next, e.g. to add a host or instance name. The
+// prefix is used as is, so include any trailing separator.
+func PrefixedRecordFunc(prefix string, next func(key string, val interface{})) func(string, interface{}) {
+	return func(key string, val interface{}) {
+		next(prefix+key, val)
+	}
+}
+
+// isCounterKey guesses whether a polled key is a monotonic counter based on
+// the naming conventions used by ExpHandler, ExpRPCServer and MemStats.
+func isCounterKey(key, sep string) bool {
+	parts := strings.Split(key, sep)
+	last := parts[len(parts)-1]
+	if isQuantileLabel(last) || strings.HasSuffix(last, "avg_ns") ||
+		strings.HasSuffix(last, "_rate") || strings.HasSuffix(last, "queue_depth") {
+		return false
+	}
+	for _, p := range parts {
+		// rate counters, e.g. "requests_per_min" or "requests.<method>.per_min"
+		if strings.HasPrefix(p, "per_") || strings.Contains(p, "_per_") {
+			return false
+		}
+	}
+
+	for _, p := range parts {
+		if p == "requests" || p == "responses" {
+			return true
+		}
+	}
+
+	switch last {
+	case "panics", "total_ns", "total", "mallocs", "frees", "lookups", "count", "total_pause_ns",
+		"dropped", "sum", "pushes":
+		return true
+	default:
+		if strings.HasPrefix(last, "le_") {
+			return true
+		}
+		_, err := strconv.Atoi(last)
+		return err == nil
+	}
+}
+
+// isQuantileLabel returns true for the quantile keys recorded by
+// recordQuantiles, e.g. "p99" or "p99_9".
+func isQuantileLabel(s string) bool {
+	if len(s) < 2 || s[0] != 'p' {
+		return false
+	}
+	for _, r := range strings.TrimPrefix(s, "p") {
+		if (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
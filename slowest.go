@@ -0,0 +1,85 @@
+package exphttp
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SlowestRequest is a thread-safe tracker of the slowest single request,
+// with optional details about which request it was.
+type SlowestRequest struct {
+	ns int64
+
+	// Details enables recording the method, path and time of the slowest
+	// request, at the cost of a lock whenever a new maximum is seen.
+	Details bool
+
+	mu     sync.Mutex
+	method string
+	path   string
+	at     time.Time
+}
+
+// Observe records a request's elapsed time (in ns), keeping it if it is the
+// slowest seen since the last Reset.
+func (s *SlowestRequest) Observe(ns int64, method, path string) {
+	for {
+		cur := atomic.LoadInt64(&s.ns)
+		if ns <= cur {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&s.ns, cur, ns) {
+			break
+		}
+	}
+	if !s.Details {
+		return
+	}
+
+	s.mu.Lock()
+	// a slower request may have already won the race
+	if atomic.LoadInt64(&s.ns) == ns {
+		s.method, s.path, s.at = method, path, time.Now()
+	}
+	s.mu.Unlock()
+}
+
+// Max returns the slowest elapsed time (in ns) since the last Reset.
+func (s *SlowestRequest) Max() int64 {
+	return atomic.LoadInt64(&s.ns)
+}
+
+// Reset clears the slowest request and returns its elapsed time (in ns).
+func (s *SlowestRequest) Reset() int64 {
+	s.mu.Lock()
+	s.method, s.path, s.at = "", "", time.Time{}
+	s.mu.Unlock()
+	return atomic.SwapInt64(&s.ns, 0)
+}
+
+// String returns Max() as a string (to implement expvar.Var).
+func (s *SlowestRequest) String() string {
+	return strconv.FormatInt(s.Max(), 10)
+}
+
+// slowestDetails is an expvar.Var exposing the details of a SlowestRequest.
+type slowestDetails struct {
+	s *SlowestRequest
+}
+
+func (d slowestDetails) String() string {
+	d.s.mu.Lock()
+	v := struct {
+		Ns     int64     `json:"ns"`
+		Method string    `json:"method"`
+		Path   string    `json:"path"`
+		Time   time.Time `json:"time"`
+	}{d.s.Max(), d.s.method, d.s.path, d.s.at}
+	d.s.mu.Unlock()
+
+	b, _ := json.Marshal(v)
+	return string(b)
+}
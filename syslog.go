@@ -0,0 +1,90 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package exphttp
+
+import (
+	"fmt"
+	"log/syslog"
+	"time"
+)
+
+// DefaultSyslogFormat is the default line format for SyslogRecorder. The
+// arguments are the plugin name, key, value and unix timestamp.
+const DefaultSyslogFormat = "%[1]s.%[2]s %[3]v %[4]d"
+
+// SyslogRecorder sends ExpPoller metrics to syslog, one line per value, for
+// hosts without a metrics agent. Use its Record method as the poller's
+// RecordFunc.
+type SyslogRecorder struct {
+	// Network and Addr are passed to syslog.Dial. Leave both empty to use
+	// the local syslog daemon.
+	Network string
+	Addr    string
+
+	// Priority is the syslog facility and severity for each line, e.g.
+	// syslog.LOG_LOCAL0|syslog.LOG_INFO.
+	Priority syslog.Priority
+
+	// Tag is the syslog tag, defaulting to the program name if empty.
+	Tag string
+
+	// Format is the fmt format for each line, defaulting to
+	// DefaultSyslogFormat if empty.
+	Format string
+
+	x        *ExpPoller
+	w        *syslog.Writer
+	failedAt time.Time
+}
+
+// NewSyslogRecorder creates a SyslogRecorder for x, and sets it as x's
+// RecordFunc. The connection is made on the first recorded value.
+func NewSyslogRecorder(x *ExpPoller, network, addr string, priority syslog.Priority, tag string) *SyslogRecorder {
+	s := &SyslogRecorder{
+		Network:  network,
+		Addr:     addr,
+		Priority: priority,
+		Tag:      tag,
+		x:        x,
+	}
+	x.RecordFunc = s.Record
+	return s
+}
+
+// Record writes a single metric line to syslog. If the connection has
+// dropped or can't be made, values are discarded until the next poll, when a
+// reconnect is attempted.
+func (s *SyslogRecorder) Record(key string, val interface{}) {
+	if s.w == nil {
+		if !s.failedAt.IsZero() && !s.x.FetchTime.After(s.failedAt) {
+			return
+		}
+		w, err := syslog.Dial(s.Network, s.Addr, s.Priority, s.Tag)
+		if err != nil {
+			s.failedAt = s.x.FetchTime
+			return
+		}
+		s.w, s.failedAt = w, time.Time{}
+	}
+
+	format := s.Format
+	if format == "" {
+		format = DefaultSyslogFormat
+	}
+	line := fmt.Sprintf(format, s.x.PluginName, key, val, s.x.FetchTime.Unix())
+	if _, err := s.w.Write([]byte(line)); err != nil {
+		s.Close()
+		s.failedAt = s.x.FetchTime
+	}
+}
+
+// Close closes the syslog connection, if open.
+func (s *SyslogRecorder) Close() error {
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
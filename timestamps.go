@@ -0,0 +1,52 @@
+package exphttp
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// timestampRing is a bounded, thread-safe ring of recent event times. Its
+// String method (to implement expvar.Var) renders a JSON array of unix
+// nanosecond timestamps, oldest first.
+type timestampRing struct {
+	mu   sync.Mutex
+	ts   []int64
+	next int
+	full bool
+}
+
+func newTimestampRing(size int) *timestampRing {
+	return &timestampRing{ts: make([]int64, size)}
+}
+
+// add records t, overwriting the oldest timestamp when full.
+func (r *timestampRing) add(t time.Time) {
+	r.mu.Lock()
+	r.ts[r.next] = t.UnixNano()
+	r.next++
+	if r.next == len(r.ts) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+func (r *timestampRing) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start, n := 0, r.next
+	if r.full {
+		start, n = r.next, len(r.ts)
+	}
+	b := make([]byte, 0, 2+n*20)
+	b = append(b, '[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, r.ts[(start+i)%len(r.ts)], 10)
+	}
+	return string(append(b, ']'))
+}
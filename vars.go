@@ -0,0 +1,84 @@
+package exphttp
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// FilteredVarsHandler returns an http.Handler that serves expvar JSON like
+// the standard /debug/vars handler, but only for the vars where include
+// returns true. If include is nil, only the vars managed by exphttp are
+// served: the "exphttp", "exprpc" and "exprpcs" maps, and the stats of each
+// ExpHandler and named ExpRPCServer.
+func FilteredVarsHandler(include func(key string) bool) http.Handler {
+	if include == nil {
+		include = isManagedVar
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writeVars(w, include)
+	})
+}
+
+// MetricsHandler returns an http.Handler that serves the same vars as
+// FilteredVarsHandler, but in the Prometheus text exposition format (labeled
+// as by PrometheusHandler) when the request's Accept header asks for
+// "text/plain; version=0.0.4". Otherwise it serves expvar JSON, so different
+// scrapers can share a single endpoint.
+func MetricsHandler(include func(key string) bool) http.Handler {
+	if include == nil {
+		include = isManagedVar
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept")
+		if !strings.Contains(accept, "text/plain") || !strings.Contains(accept, "version=0.0.4") {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			writeVars(w, include)
+			return
+		}
+
+		writePrometheus(w, include)
+	})
+}
+
+// localVars collects the vars published in this process as if they had
+// been fetched by an ExpPoller.
+func localVars(include func(key string) bool) map[string]json.RawMessage {
+	vars := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if include(kv.Key) {
+			vars[kv.Key] = json.RawMessage(kv.Value.String())
+		}
+	})
+	return vars
+}
+
+func writeVars(w io.Writer, include func(key string) bool) {
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !include(kv.Key) {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// isManagedVar returns true for top-level vars published by exphttp.
+func isManagedVar(key string) bool {
+	switch key {
+	case "exphttp", "exprpc", "exprpcs", "buildinfo":
+		return true
+	}
+	return (expHandlers != nil && expHandlers.Get(key) != nil) ||
+		(rpcServers != nil && rpcServers.Get(key) != nil)
+}
@@ -0,0 +1,76 @@
+package exphttp
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// WalkAll records every numeric value in the fetched vars, so that
+// application maps like expvar.NewMap("mycache") are reported too. Nested
+// objects are flattened into keys like "mycache.hits" under the "vars"
+// plugin, and non-numeric values are skipped.
+//
+// Top-level vars named in Skip are not walked. If Skip is nil, the vars
+// already reported by MemStats, HTTPStats, RPCStats, PoolStats and BuildInfo
+// are skipped instead, along with "cmdline".
+func (x *ExpPoller) WalkAll() error {
+	skip := make(map[string]bool)
+	if x.Skip != nil {
+		for _, name := range x.Skip {
+			skip[name] = true
+		}
+	} else {
+		x.knownVars(skip)
+	}
+
+	names := make([]string, 0, len(x.Vars))
+	for name := range x.Vars {
+		if !skip[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	x.PluginName = "vars"
+	var firstErr error
+	for _, name := range names {
+		var v interface{}
+		if err := json.Unmarshal(x.Vars[name], &v); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		switch val := v.(type) {
+		case float64:
+			x.record(name, val)
+		case map[string]interface{}:
+			r := make(map[string]float64)
+			flattenStats(r, name+x.sep(), x.sep(), val)
+			keys := make([]string, 0, len(r))
+			for k := range r {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				x.record(k, r[k])
+			}
+		}
+	}
+	return firstErr
+}
+
+// knownVars adds the names of vars handled by the other stat methods to m.
+func (x *ExpPoller) knownVars(m map[string]bool) {
+	for _, name := range []string{"cmdline", "memstats", "exphttp", "exprpc", "exprpcs", "pools", "buildinfo"} {
+		m[name] = true
+	}
+	for _, list := range []string{"exphttp", "exprpcs"} {
+		var names map[string]int
+		if json.Unmarshal(x.Vars[list], &names) == nil {
+			for name := range names {
+				m[name] = true
+			}
+		}
+	}
+}